@@ -3,25 +3,616 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/bitwurx/jrpc2"
 )
 
 const (
-	TimetableNotFoundCode jrpc2.ErrorCode = -32002 // timetable not found json rpc 2.0 error code.
+	TimetableNotFoundCode  jrpc2.ErrorCode = -32002 // timetable not found json rpc 2.0 error code.
+	EmptyScheduleCode      jrpc2.ErrorCode = -32003 // empty schedule json rpc 2.0 error code.
+	RevisionConflictCode   jrpc2.ErrorCode = -32004 // revision conflict json rpc 2.0 error code.
+	DuplicateTaskCode      jrpc2.ErrorCode = -32005 // duplicate task json rpc 2.0 error code.
+	TaskNotFoundCode       jrpc2.ErrorCode = -32006 // task not found json rpc 2.0 error code.
+	ScheduleConflictCode   jrpc2.ErrorCode = -32007 // schedule conflict json rpc 2.0 error code.
+	InvalidRunAtCode       jrpc2.ErrorCode = -32008 // invalid run at time json rpc 2.0 error code.
+	StorageUnavailableCode jrpc2.ErrorCode = -32009 // storage unavailable json rpc 2.0 error code.
+	InvalidTimeZoneCode    jrpc2.ErrorCode = -32010 // invalid time zone json rpc 2.0 error code.
+	InvalidLeaseTokenCode  jrpc2.ErrorCode = -32011 // invalid lease token json rpc 2.0 error code.
 )
 
 const (
-	TimetableNotFoundMsg jrpc2.ErrorMsg = "Timetable not found" // timetable not found json rpc 2.0 error message.
+	TimetableNotFoundMsg  jrpc2.ErrorMsg = "Timetable not found"           // timetable not found json rpc 2.0 error message.
+	EmptyScheduleMsg      jrpc2.ErrorMsg = "Timetable schedule is empty"   // empty schedule json rpc 2.0 error message.
+	RevisionConflictMsg   jrpc2.ErrorMsg = "Timetable revision conflict"   // revision conflict json rpc 2.0 error message.
+	DuplicateTaskMsg      jrpc2.ErrorMsg = "Task id already exists"        // duplicate task json rpc 2.0 error message.
+	TaskNotFoundMsg       jrpc2.ErrorMsg = "Task not found"                // task not found json rpc 2.0 error message.
+	ScheduleConflictMsg   jrpc2.ErrorMsg = "Run at time already reserved"  // schedule conflict json rpc 2.0 error message.
+	InvalidRunAtMsg       jrpc2.ErrorMsg = "Invalid run at time"           // invalid run at time json rpc 2.0 error message.
+	StorageUnavailableMsg jrpc2.ErrorMsg = "Timetable storage unavailable" // storage unavailable json rpc 2.0 error message.
+	InvalidTimeZoneMsg    jrpc2.ErrorMsg = "Invalid time zone"             // invalid time zone json rpc 2.0 error message.
+	InvalidLeaseTokenMsg  jrpc2.ErrorMsg = "Invalid lease token"           // invalid lease token json rpc 2.0 error message.
 )
 
-// ApiV1 is the version 1 implementation of the rpc methods.
+const (
+	MaxPreviewOccurrences = 1000            // the maximum number of occurrences returned by preview.
+	MaxBatchSize          = 1000            // the maximum number of items in a batch call.
+	MaxWaitTimeout        = time.Minute * 5 // the longest time wait blocks for a due task.
+	DefaultMaxPayloadSize = 64 * 1024       // the default maximum size of a task payload in bytes.
+	MaxConflictRetries    = 3               // the number of times a mutation is retried after a revision conflict.
+	DefaultCacheTTL       = time.Second     // the default time a timetable is served from memory before it is fetched again.
+)
+
+const (
+	DelayUnitMillis  = "ms"      // delay in whole milliseconds.
+	DelayUnitSeconds = "s"       // delay in fractional seconds.
+	DelayUnitISO8601 = "iso8601" // delay as an ISO 8601 duration.
+)
+
+// ApiV1 is the version 1 implementation of the rpc methods.  The rpc
+// methods are safe to call concurrently.  Timetables are cached in
+// memory and fetched again from the model once they are older than
+// CacheTTL, so replicas sharing a model see each other's changes.
 type ApiV1 struct {
 	// model the priority timetable database model.
 	// timetables is a represetation of timetables by key.
-	model      Model
-	timetables map[string]*Timetable
+	// refreshed holds the time each timetable was last fetched.
+	// listed is the time the stored timetables were last listed.
+	// MaxPayloadSize is the maximum size of a task payload in bytes.
+	// CacheTTL is the time a timetable is served from memory.
+	// mu guards the timetables registry.  Each timetable is guarded by
+	// its own lock.
+	model          Model
+	timetables     map[string]*Timetable
+	refreshed      map[string]time.Time
+	listed         time.Time
+	MaxPayloadSize int
+	CacheTTL       time.Duration
+	mu             sync.RWMutex
+}
+
+// timetable returns the timetable with the provided key from the
+// registry.  A timetable older than CacheTTL is refreshed in place and a
+// timetable missing from the registry is looked up in the model.  A
+// storage error is returned if the model cannot be read.
+func (api *ApiV1) timetable(key string) (*Timetable, *jrpc2.ErrorObject) {
+	api.mu.RLock()
+	timetable, ok := api.timetables[key]
+	fresh := ok && time.Since(api.refreshed[key]) < api.CacheTTL
+	api.mu.RUnlock()
+	if fresh {
+		return timetable, nil
+	}
+	if ok {
+		if err := api.refresh(timetable); err != nil {
+			log.Println(err)
+			return nil, storageError(err)
+		}
+		return timetable, nil
+	}
+
+	stored, err := api.model.Fetch(key)
+	if err != nil {
+		log.Println(err)
+		return nil, storageError(err)
+	}
+	if stored == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    TimetableNotFoundCode,
+			Message: TimetableNotFoundMsg,
+		}
+	}
+	return api.register(stored.(*Timetable)), nil
+}
+
+// timetableOrCreate returns the timetable with the provided key,
+// registering a new empty timetable if it is not stored.
+func (api *ApiV1) timetableOrCreate(key string) (*Timetable, *jrpc2.ErrorObject) {
+	timetable, errObj := api.timetable(key)
+	if errObj != nil && errObj.Code == TimetableNotFoundCode {
+		return api.register(NewTimetable(key)), nil
+	}
+	return timetable, errObj
+}
+
+// register adds the timetable to the registry and returns it, or returns
+// the timetable already registered with its key.
+func (api *ApiV1) register(timetable *Timetable) *Timetable {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if registered, ok := api.timetables[timetable.Key]; ok {
+		return registered
+	}
+	api.timetables[timetable.Key] = timetable
+	api.refreshed[timetable.Key] = time.Now()
+	return timetable
+}
+
+// refresh replaces the timetable with its stored version if the stored
+// revision differs.  The timetable is fetched without holding its lock
+// and is left as it is if it changed in the meantime.  Timetables that
+// are not stored are left as they are.
+func (api *ApiV1) refresh(timetable *Timetable) error {
+	timetable.mu.RLock()
+	rev := timetable.rev
+	timetable.mu.RUnlock()
+	stored, err := api.model.Fetch(timetable.Key)
+	if err != nil {
+		return err
+	}
+	other, _ := stored.(*Timetable)
+	api.update(timetable, rev, other)
+	return nil
+}
+
+// update replaces the timetable with the stored version fetched while
+// the timetable was at the provided revision, unless the revisions match
+// or the timetable changed since.  A nil stored version leaves the
+// timetable as it is.
+func (api *ApiV1) update(timetable *Timetable, rev string, stored *Timetable) {
+	timetable.mu.Lock()
+	if stored != nil && stored.rev != rev && timetable.rev == rev {
+		timetable.replace(stored)
+	}
+	timetable.mu.Unlock()
+	api.mu.Lock()
+	api.refreshed[timetable.Key] = time.Now()
+	api.mu.Unlock()
+}
+
+// list returns the registered timetables.  Once the last listing is
+// older than CacheTTL all stored timetables are read in one call, which
+// refreshes the registered timetables and registers the timetables
+// stored by other replicas.
+func (api *ApiV1) list() []*Timetable {
+	api.mu.RLock()
+	fresh := time.Since(api.listed) < api.CacheTTL
+	registry := make(map[string]*Timetable, len(api.timetables))
+	for key, timetable := range api.timetables {
+		registry[key] = timetable
+	}
+	api.mu.RUnlock()
+
+	listed := false
+	if !fresh {
+		revs := make(map[string]string, len(registry))
+		for key, timetable := range registry {
+			timetable.mu.RLock()
+			revs[key] = timetable.rev
+			timetable.mu.RUnlock()
+		}
+		stored, err := api.model.FetchAll()
+		if err != nil {
+			log.Println(err)
+		} else {
+			for _, v := range stored {
+				other := v.(*Timetable)
+				if timetable, ok := registry[other.Key]; ok {
+					api.update(timetable, revs[other.Key], other)
+				} else {
+					registry[other.Key] = api.register(other)
+				}
+			}
+			listed = true
+		}
+		api.mu.Lock()
+		api.listed = time.Now()
+		api.mu.Unlock()
+	}
+
+	timetables := make([]*Timetable, 0, len(registry))
+	for key, timetable := range registry {
+		if listed {
+			timetables = append(timetables, timetable)
+		} else if timetable, errObj := api.timetable(key); errObj == nil {
+			timetables = append(timetables, timetable)
+		}
+	}
+	return timetables
+}
+
+// reload replaces the timetable with its stored version.  The caller
+// must hold the timetable write lock.
+func (api *ApiV1) reload(timetable *Timetable) error {
+	stored, err := api.model.Fetch(timetable.Key)
+	if err != nil {
+		return err
+	}
+	other, _ := stored.(*Timetable)
+	timetable.replace(other)
+	return nil
+}
+
+// retry runs the mutation of the timetable, reloading the timetable and
+// running the mutation again each time it fails with a revision
+// conflict.  The caller must hold the timetable write lock.
+func (api *ApiV1) retry(timetable *Timetable, mutate func() (interface{}, *jrpc2.ErrorObject)) (interface{}, *jrpc2.ErrorObject) {
+	for i := 0; ; i++ {
+		result, errObj := mutate()
+		if errObj == nil || errObj.Code != RevisionConflictCode || i == MaxConflictRetries {
+			return result, errObj
+		}
+		if err := api.reload(timetable); err != nil {
+			log.Println(err)
+			return nil, storageError(err)
+		}
+	}
+}
+
+// ErrorData is the structured data of the application errors.
+type ErrorData struct {
+	// Id is the id of the task the error is about.
+	// Field is the name of the offending parameter.
+	// Task is the task in the timetable the call conflicts with.
+	// Error describes the failure.
+	Id    string `json:"id,omitempty"`
+	Field string `json:"field,omitempty"`
+	Task  *Task  `json:"task,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// storageError returns the rpc error of a failed model write.
+func storageError(err error) *jrpc2.ErrorObject {
+	if errors.Is(err, ErrRevisionConflict) {
+		return &jrpc2.ErrorObject{
+			Code:    RevisionConflictCode,
+			Message: RevisionConflictMsg,
+			Data:    &ErrorData{Error: err.Error()},
+		}
+	}
+	return &jrpc2.ErrorObject{
+		Code:    StorageUnavailableCode,
+		Message: StorageUnavailableMsg,
+		Data:    &ErrorData{Error: err.Error()},
+	}
+}
+
+// taskError returns the rpc error of a failed timetable operation on the
+// task with the provided id.  RunAt is the run at time the task was to be
+// scheduled at, if any.  The timetable lock must be held.
+func taskError(timetable *Timetable, id string, runAt string, err error) *jrpc2.ErrorObject {
+	switch {
+	case errors.Is(err, ErrTaskNotFound):
+		return &jrpc2.ErrorObject{
+			Code:    TaskNotFoundCode,
+			Message: TaskNotFoundMsg,
+			Data:    &ErrorData{Id: id},
+		}
+	case errors.Is(err, ErrDuplicateTask):
+		task, _ := timetable.Lookup(id)
+		return &jrpc2.ErrorObject{
+			Code:    DuplicateTaskCode,
+			Message: DuplicateTaskMsg,
+			Data:    &ErrorData{Id: id, Field: "id", Task: snapshotTask(task)},
+		}
+	case errors.Is(err, ErrScheduleConflict):
+		var task *Task
+		if at, err := time.Parse(time.RFC3339, runAt); err == nil {
+			task = timetable.schedule.reservation(at)
+		}
+		return &jrpc2.ErrorObject{
+			Code:    ScheduleConflictCode,
+			Message: ScheduleConflictMsg,
+			Data:    &ErrorData{Id: id, Field: "runAt", Task: snapshotTask(task)},
+		}
+	case errors.Is(err, ErrInvalidLeaseToken):
+		return &jrpc2.ErrorObject{
+			Code:    InvalidLeaseTokenCode,
+			Message: InvalidLeaseTokenMsg,
+			Data:    &ErrorData{Id: id, Field: "leaseToken"},
+		}
+	}
+	return &jrpc2.ErrorObject{
+		Code:    jrpc2.InternalErrorCode,
+		Message: jrpc2.InternalErrorMsg,
+		Data:    &ErrorData{Id: id, Error: err.Error()},
+	}
+}
+
+// internalError returns the rpc error of an unexpected failure.
+func internalError(err error) *jrpc2.ErrorObject {
+	return &jrpc2.ErrorObject{
+		Code:    jrpc2.InternalErrorCode,
+		Message: jrpc2.InternalErrorMsg,
+		Data:    &ErrorData{Error: err.Error()},
+	}
+}
+
+// invalidRunAt returns the rpc error of a run at time, recurrence or
+// retry time in the named field that cannot be scheduled.
+func invalidRunAt(id string, field string, err error) *jrpc2.ErrorObject {
+	return &jrpc2.ErrorObject{
+		Code:    InvalidRunAtCode,
+		Message: InvalidRunAtMsg,
+		Data:    &ErrorData{Id: id, Field: field, Error: err.Error()},
+	}
+}
+
+// invalidParams returns the rpc error of a missing or malformed
+// parameter in the named field.
+func invalidParams(id string, field string, msg string) *jrpc2.ErrorObject {
+	return &jrpc2.ErrorObject{
+		Code:    jrpc2.InvalidParamsCode,
+		Message: jrpc2.InvalidParamsMsg,
+		Data:    &ErrorData{Id: id, Field: field, Error: msg},
+	}
+}
+
+// invalidTimeZone returns the rpc error of a time zone that cannot be
+// loaded.
+func invalidTimeZone(id string, err error) *jrpc2.ErrorObject {
+	return &jrpc2.ErrorObject{
+		Code:    InvalidTimeZoneCode,
+		Message: InvalidTimeZoneMsg,
+		Data:    &ErrorData{Id: id, Field: "timeZone", Error: err.Error()},
+	}
+}
+
+// snapshotTask copies the task for clients so that it can be encoded
+// after the timetable lock is released.
+func snapshotTask(task *Task) *Task {
+	if task == nil {
+		return nil
+	}
+	return task.view()
+}
+
+// snapshot serializes the client view of the timetable while holding
+// its read lock so the result can be encoded after the lock is released.
+func snapshot(timetable *Timetable) (json.RawMessage, error) {
+	timetable.mu.RLock()
+	defer timetable.mu.RUnlock()
+	return json.Marshal(timetable.view())
+}
+
+// AckParams contains the rpc parameters for the Ack method.
+type AckParams struct {
+	// Key is the timetable key.
+	// Id is the id of the claimed task.
+	// LeaseToken is the token returned by claim.
+	Key        *string `json:"key"`
+	Id         *string `json:"id"`
+	LeaseToken *string `json:"leaseToken"`
+}
+
+// FromPositional parses the key, id and leaseToken from the positional
+// parameters.
+func (params *AckParams) FromPositional(args []interface{}) error {
+	if len(args) != 3 {
+		return errors.New("key, id, and leaseToken parameters are required")
+	}
+	key, ok := args[0].(string)
+	if !ok {
+		return errors.New("key must be a string")
+	}
+	id, ok := args[1].(string)
+	if !ok {
+		return errors.New("id must be a string")
+	}
+	token, ok := args[2].(string)
+	if !ok {
+		return errors.New("leaseToken must be a string")
+	}
+	params.Key = &key
+	params.Id = &id
+	params.LeaseToken = &token
+
+	return nil
+}
+
+// Ack completes a claimed task and releases its lease.
+func (api *ApiV1) Ack(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(AckParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Key == nil {
+		return nil, invalidParams("", "key", "task key is required")
+	}
+	if p.Id == nil {
+		return nil, invalidParams("", "id", "task id is required")
+	}
+	if p.LeaseToken == nil {
+		return nil, invalidParams("", "leaseToken", "lease token is required")
+	}
+	timetable, errObj := api.timetable(*p.Key)
+	if errObj != nil {
+		return nil, errObj
+	}
+
+	timetable.mu.Lock()
+	defer timetable.mu.Unlock()
+	return api.retry(timetable, func() (interface{}, *jrpc2.ErrorObject) {
+		lease, err := timetable.Ack(*p.Id, *p.LeaseToken)
+		if err != nil {
+			return nil, taskError(timetable, *p.Id, "", err)
+		}
+		if err := timetable.SaveTasks(api.model, lease.Task.Id); err != nil {
+			log.Println(err)
+			timetable.restoreLease(lease)
+			return nil, storageError(err)
+		}
+		return 0, nil
+	})
+}
+
+// ClaimParams contains the rpc parameters for the Claim method.
+type ClaimParams struct {
+	// Key is the timetable key.
+	// WorkerId identifies the claiming worker.
+	// LeaseSeconds is the duration of the lease in seconds.
+	Key          *string `json:"key"`
+	WorkerId     *string `json:"workerId"`
+	LeaseSeconds *int    `json:"leaseSeconds"`
+}
+
+// FromPositional parses the key, workerId and leaseSeconds from the
+// positional parameters.
+func (params *ClaimParams) FromPositional(args []interface{}) error {
+	if len(args) != 3 {
+		return errors.New("key, workerId, and leaseSeconds parameters are required")
+	}
+	key, ok := args[0].(string)
+	if !ok {
+		return errors.New("key must be a string")
+	}
+	workerId, ok := args[1].(string)
+	if !ok {
+		return errors.New("workerId must be a string")
+	}
+	leaseSeconds, ok := intArg(args[2])
+	if !ok {
+		return errors.New("leaseSeconds must be a number")
+	}
+	params.Key = &key
+	params.WorkerId = &workerId
+	params.LeaseSeconds = &leaseSeconds
+
+	return nil
+}
+
+// Claim leases the next due task in the timetable to a worker.  The task
+// is handed out again if it is not acknowledged before the lease expires.
+func (api *ApiV1) Claim(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(ClaimParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Key == nil {
+		return nil, invalidParams("", "key", "task key is required")
+	}
+	if p.WorkerId == nil {
+		return nil, invalidParams("", "workerId", "worker id is required")
+	}
+	if p.LeaseSeconds == nil || *p.LeaseSeconds < 1 {
+		return nil, invalidParams("", "leaseSeconds", "lease seconds must be a positive number")
+	}
+	timetable, errObj := api.timetable(*p.Key)
+	if errObj != nil {
+		return nil, errObj
+	}
+
+	timetable.mu.Lock()
+	defer timetable.mu.Unlock()
+	return api.retry(timetable, func() (interface{}, *jrpc2.ErrorObject) {
+		lease, prev, err := timetable.claim(*p.WorkerId, time.Duration(*p.LeaseSeconds)*time.Second)
+		if err != nil {
+			return nil, internalError(err)
+		}
+		if lease == nil {
+			return lease, nil
+		}
+		if err := timetable.SaveTasks(api.model, lease.Task.Id); err != nil {
+			log.Println(err)
+			timetable.unclaim(lease, prev)
+			return nil, storageError(err)
+		}
+		view := *lease
+		view.Task = lease.Task.view()
+		return &view, nil
+	})
+}
+
+// ConfigureParams contains the rpc parameters for the Configure method.
+type ConfigureParams struct {
+	// Key is the timetable key.
+	// Exclusive reserves each run at time for a single task.
+	// TimeZone is the default time zone of the timetable tasks.
+	// Callback is the default callback of the timetable tasks.
+	// Order is the order due tasks are handed out in.
+	Key       *string   `json:"key"`
+	Exclusive *bool     `json:"exclusive"`
+	TimeZone  *string   `json:"timeZone"`
+	Callback  *Callback `json:"callback"`
+	Order     *string   `json:"order"`
+}
+
+// FromPositional parses the key, exclusive setting and optional time
+// zone from the positional parameters.
+func (params *ConfigureParams) FromPositional(args []interface{}) error {
+	if len(args) != 2 && len(args) != 3 {
+		return errors.New("key and exclusive parameters are required")
+	}
+	key, ok := args[0].(string)
+	if !ok {
+		return errors.New("key must be a string")
+	}
+	exclusive, ok := args[1].(bool)
+	if !ok {
+		return errors.New("exclusive must be a boolean")
+	}
+	params.Key = &key
+	params.Exclusive = &exclusive
+	if len(args) == 3 {
+		timeZone, ok := args[2].(string)
+		if !ok {
+			return errors.New("timeZone must be a string")
+		}
+		params.TimeZone = &timeZone
+	}
+
+	return nil
+}
+
+// Configure changes the settings of a timetable.  The timetable is
+// created if it does not exist.
+func (api *ApiV1) Configure(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(ConfigureParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Key == nil {
+		return nil, invalidParams("", "key", "timetable key is required")
+	}
+	if p.TimeZone != nil {
+		if _, err := LoadLocation(*p.TimeZone); err != nil {
+			return nil, invalidTimeZone("", err)
+		}
+	}
+	if p.Callback != nil && p.Callback.Url != "" {
+		if err := p.Callback.Validate(); err != nil {
+			return nil, invalidParams("", "callback", err.Error())
+		}
+	}
+	if p.Order != nil && *p.Order != OrderTime && *p.Order != OrderPriority {
+		return nil, invalidParams("", "order", fmt.Sprintf("order must be %q or %q", OrderTime, OrderPriority))
+	}
+
+	timetable, errObj := api.timetableOrCreate(*p.Key)
+	if errObj != nil {
+		return nil, errObj
+	}
+	timetable.mu.Lock()
+	defer timetable.mu.Unlock()
+	return api.retry(timetable, func() (interface{}, *jrpc2.ErrorObject) {
+		exclusive, timeZone, callback, order := timetable.Exclusive, timetable.TimeZone, timetable.Callback, timetable.Order
+		if p.Exclusive != nil {
+			timetable.Exclusive = *p.Exclusive
+		}
+		if p.TimeZone != nil {
+			timetable.TimeZone = *p.TimeZone
+		}
+		if p.Callback != nil {
+			// a callback without a url removes the timetable callback.
+			timetable.Callback = p.Callback
+			if p.Callback.Url == "" {
+				timetable.Callback = nil
+			}
+		}
+		if p.Order != nil {
+			timetable.Order = *p.Order
+		}
+		if _, err := timetable.Save(api.model); err != nil {
+			log.Println(err)
+			timetable.Exclusive, timetable.TimeZone, timetable.Callback, timetable.Order = exclusive, timeZone, callback, order
+			return nil, storageError(err)
+		}
+		return 0, nil
+	})
 }
 
 // DelayParams contains the rpc parameters for the Delay method.
@@ -48,28 +639,116 @@ func (api *ApiV1) Delay(params json.RawMessage) (interface{}, *jrpc2.ErrorObject
 		return nil, err
 	}
 	if p.Key == nil {
+		return nil, invalidParams("", "key", "timetable key is required")
+	}
+	timetable, errObj := api.timetable(*p.Key)
+	if errObj != nil {
+		return nil, errObj
+	}
+	timetable.mu.RLock()
+	delay, err := timetable.Delay()
+	timetable.mu.RUnlock()
+	if err == ErrEmptySchedule {
 		return nil, &jrpc2.ErrorObject{
-			Code:    jrpc2.InvalidParamsCode,
-			Message: jrpc2.InvalidParamsMsg,
-			Data:    "timetable key is required",
+			Code:    EmptyScheduleCode,
+			Message: EmptyScheduleMsg,
 		}
 	}
-	timetable, ok := api.timetables[*p.Key]
+	if err != nil {
+		return nil, internalError(err)
+	}
+	return delay, nil
+}
+
+// DueParams contains the rpc parameters for the Due method.
+type DueParams struct {
+	// Key is the timetable key.
+	// Unit is the unit of the returned delay.
+	Key  *string `json:"key"`
+	Unit *string `json:"unit"`
+}
+
+// FromPositional parses the key and optional unit from the positional
+// parameters.
+func (params *DueParams) FromPositional(args []interface{}) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("key parameter is required")
+	}
+	key, ok := args[0].(string)
 	if !ok {
-		return nil, &jrpc2.ErrorObject{
-			Code:    TimetableNotFoundCode,
-			Message: TimetableNotFoundMsg,
+		return errors.New("key must be a string")
+	}
+	params.Key = &key
+	if len(args) == 2 {
+		unit, ok := args[1].(string)
+		if !ok {
+			return errors.New("unit must be a string")
 		}
+		params.Unit = &unit
 	}
-	delay, err := timetable.Delay()
-	if err != nil {
+
+	return nil
+}
+
+// Due is the due time of the next scheduled task and the precise delay
+// until it.
+type Due struct {
+	// RunAt is the run at time of the next scheduled task.
+	// Delay is the time until the task is due in the requested unit.  It
+	// is zero once the task is overdue.
+	// Unit is the unit of the delay.
+	// Overdue reports whether the run at time has passed.
+	RunAt   string      `json:"runAt"`
+	Delay   interface{} `json:"delay"`
+	Unit    string      `json:"unit"`
+	Overdue bool        `json:"overdue"`
+}
+
+// Due returns the run at time of the next scheduled task and the delay
+// until it in milliseconds, seconds or as an ISO 8601 duration.
+func (api *ApiV1) Due(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(DueParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Key == nil {
+		return nil, invalidParams("", "key", "timetable key is required")
+	}
+	unit := DelayUnitMillis
+	if p.Unit != nil {
+		unit = *p.Unit
+	}
+	if unit != DelayUnitMillis && unit != DelayUnitSeconds && unit != DelayUnitISO8601 {
+		return nil, invalidParams("", "unit", fmt.Sprintf("unit must be one of %s, %s or %s", DelayUnitMillis, DelayUnitSeconds, DelayUnitISO8601))
+	}
+	timetable, errObj := api.timetable(*p.Key)
+	if errObj != nil {
+		return nil, errObj
+	}
+	timetable.mu.RLock()
+	at, ok := timetable.NextRunAt()
+	timetable.mu.RUnlock()
+	if !ok {
 		return nil, &jrpc2.ErrorObject{
-			Code:    -32099,
-			Message: jrpc2.ServerErrorMsg,
-			Data:    err.Error(),
+			Code:    EmptyScheduleCode,
+			Message: EmptyScheduleMsg,
 		}
 	}
-	return delay, nil
+	due := &Due{RunAt: FormatRunAt(at), Unit: unit}
+	delay := time.Until(at)
+	if delay <= 0 {
+		delay = 0
+		due.Overdue = true
+	}
+	switch unit {
+	case DelayUnitMillis:
+		due.Delay = delay.Milliseconds()
+	case DelayUnitSeconds:
+		due.Delay = delay.Seconds()
+	case DelayUnitISO8601:
+		due.Delay = FormatDuration(delay)
+	}
+	return due, nil
 }
 
 // GetParams contains the rpc parameters for the Get method.
@@ -97,49 +776,125 @@ func (api *ApiV1) Get(params json.RawMessage) (interface{}, *jrpc2.ErrorObject)
 		return nil, err
 	}
 	if p.Key == nil {
-		return nil, &jrpc2.ErrorObject{
-			Code:    jrpc2.InvalidParamsCode,
-			Message: jrpc2.InvalidParamsMsg,
-			Data:    "timetable key is required",
-		}
+		return nil, invalidParams("", "key", "timetable key is required")
 	}
-	timetable, ok := api.timetables[*p.Key]
-	if !ok {
-		return nil, &jrpc2.ErrorObject{
-			Code:    TimetableNotFoundCode,
-			Message: TimetableNotFoundMsg,
-		}
+	timetable, errObj := api.timetable(*p.Key)
+	if errObj != nil {
+		return nil, errObj
+	}
+	data, err := snapshot(timetable)
+	if err != nil {
+		return nil, internalError(err)
 	}
-	return timetable, nil
+	return data, nil
 }
 
 // GetAll returns all existing timetables.
 func (api *ApiV1) GetAll(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
-	timetables := make([]*Timetable, 0)
-	for _, timetable := range api.timetables {
-		timetables = append(timetables, timetable)
+	registry := api.list()
+	timetables := make([]json.RawMessage, 0, len(registry))
+	for _, timetable := range registry {
+		data, err := snapshot(timetable)
+		if err != nil {
+			return nil, internalError(err)
+		}
+		timetables = append(timetables, data)
 	}
 	return timetables, nil
 }
 
+// RunAtParam is a run at time parameter.  It is given as a string in any
+// of the forms accepted by ParseRunAt or as a number of unix epoch
+// seconds or milliseconds.
+type RunAtParam string
+
+// UnmarshalJSON accepts a JSON string or number.
+func (runAt *RunAtParam) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	s, ok := runAtArg(v)
+	if !ok {
+		return errors.New("runAt must be a string or a number")
+	}
+	*runAt = RunAtParam(s)
+	return nil
+}
+
+// runAtArg returns the run at time of a decoded JSON value, formatting
+// numbers as epoch values.  False is returned if the value is neither a
+// string nor a number.
+func runAtArg(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case string:
+		return v, true
+	}
+	return "", false
+}
+
+// intArg returns the integer value of a positional number parameter.
+func intArg(v interface{}) (int, bool) {
+	n, ok := v.(float64)
+	return int(n), ok
+}
+
 // InsertParams contains the rpc parameters for Insert method.
 type InsertParams struct {
 	// Key is the timetable key.
 	// Id is the id of the task.
 	// RunAt in the execution point of time of the task
-	Key   *string `json:"key"`
-	Id    *string `json:"id"`
-	RunAt *string `json:"runAt"`
+	// Cron is the optional cron expression of a recurring task.
+	// RRule is the optional RFC 5545 recurrence rule of a recurring task.
+	// TimeZone is the optional time zone of the recurrence.
+	// Callback is the optional request sent when the task comes due.
+	// Payload is the optional JSON document handed to the worker.
+	// Labels are the optional string metadata of the task.
+	// Priority is the optional priority of the task.
+	// Idempotent accepts the insert of a task that already exists with
+	// the same run at time and payload.
+	Key        *string           `json:"key"`
+	Id         *string           `json:"id"`
+	RunAt      *RunAtParam       `json:"runAt"`
+	Cron       *string           `json:"cron"`
+	RRule      *string           `json:"rrule"`
+	TimeZone   *string           `json:"timeZone"`
+	Callback   *Callback         `json:"callback"`
+	Payload    json.RawMessage   `json:"payload"`
+	Labels     map[string]string `json:"labels"`
+	Priority   *int              `json:"priority"`
+	Idempotent *bool             `json:"idempotent"`
 }
 
-// FromPositional parse the key, id, and runAt from the positional parameters.
+// FromPositional parse the key, id, and runAt and the optional cron and
+// timeZone from the positional parameters.
 func (params *InsertParams) FromPositional(args []interface{}) error {
-	if len(args) != 3 {
+	if len(args) < 3 || len(args) > 5 {
 		return errors.New("key, id, and runAt parameters are required")
 	}
+	if len(args) > 3 {
+		cron, ok := args[3].(string)
+		if !ok {
+			return errors.New("cron must be a string")
+		}
+		params.Cron = &cron
+	}
+	if len(args) > 4 {
+		timeZone, ok := args[4].(string)
+		if !ok {
+			return errors.New("timeZone must be a string")
+		}
+		params.TimeZone = &timeZone
+	}
 	key := args[0].(string)
 	id := args[1].(string)
-	runAt := args[2].(string)
+	v, ok := runAtArg(args[2])
+	if !ok {
+		return errors.New("runAt must be a string or a number")
+	}
+	runAt := RunAtParam(v)
 	params.Key = &key
 	params.Id = &id
 	params.RunAt = &runAt
@@ -147,58 +902,345 @@ func (params *InsertParams) FromPositional(args []interface{}) error {
 	return nil
 }
 
-// Insert adds the task to the timetable schedule.
+// Insert adds the task to the timetable schedule.  Task ids are unique
+// within a timetable.
 func (api *ApiV1) Insert(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
 	p := new(InsertParams)
 	if err := jrpc2.ParseParams(params, p); err != nil {
 		return nil, err
 	}
 	if p.Key == nil {
-		return nil, &jrpc2.ErrorObject{
-			Code:    jrpc2.InvalidParamsCode,
-			Message: jrpc2.InvalidParamsMsg,
-			Data:    "task key is required",
+		return nil, invalidParams("", "key", "task key is required")
+	}
+	timetable, timeZone, errObj := api.timetableZone(*p.Key)
+	if errObj != nil {
+		return nil, errObj
+	}
+	task, errObj := api.newTask(timeZone, p)
+	if errObj != nil {
+		return nil, errObj
+	}
+
+	if timetable == nil {
+		timetable = api.register(NewTimetable(*p.Key))
+	}
+	timetable.mu.Lock()
+	defer timetable.mu.Unlock()
+	return api.retry(timetable, func() (interface{}, *jrpc2.ErrorObject) {
+		if existing, ok := timetable.Lookup(task.Id); ok && p.Idempotent != nil && *p.Idempotent && existing.Identical(task) {
+			return 0, nil
 		}
+		if err := timetable.Insert(task); err != nil {
+			return nil, taskError(timetable, task.Id, task.RunAt, err)
+		}
+		if err := timetable.SaveTasks(api.model, task.Id); err != nil {
+			log.Println(err)
+			timetable.Remove(task.Id)
+			return nil, storageError(err)
+		}
+		return 0, nil
+	})
+}
+
+// timetableZone returns the timetable with the provided key, or nil if
+// it is not stored, and the time zone of the tasks inserted without one.
+func (api *ApiV1) timetableZone(key string) (*Timetable, string, *jrpc2.ErrorObject) {
+	timetable, errObj := api.timetable(key)
+	if errObj != nil {
+		if errObj.Code == TimetableNotFoundCode {
+			return nil, "", nil
+		}
+		return nil, "", errObj
 	}
+	timetable.mu.RLock()
+	defer timetable.mu.RUnlock()
+	return timetable, timetable.TimeZone, nil
+}
+
+// newTask builds and schedules the task of the insert parameters.  Tasks
+// without a time zone take the provided time zone.  The key parameter is
+// ignored.
+func (api *ApiV1) newTask(timeZone string, p *InsertParams) (*Task, *jrpc2.ErrorObject) {
 	if p.Id == nil {
-		return nil, &jrpc2.ErrorObject{
-			Code:    jrpc2.InvalidParamsCode,
-			Message: jrpc2.InvalidParamsMsg,
-			Data:    "task id is required",
+		return nil, invalidParams("", "id", "task id is required")
+	}
+	task := &Task{Id: *p.Id}
+	if p.Cron != nil {
+		task.Cron = *p.Cron
+	}
+	if p.RRule != nil {
+		task.RRule = *p.RRule
+	}
+	if p.Callback != nil {
+		if err := p.Callback.Validate(); err != nil {
+			return nil, invalidParams(*p.Id, "callback", err.Error())
 		}
+		task.Callback = p.Callback
 	}
-	if p.RunAt == nil {
+	if len(p.Payload) > api.MaxPayloadSize {
+		return nil, invalidParams(*p.Id, "payload", fmt.Sprintf("task payload exceeds %d bytes", api.MaxPayloadSize))
+	}
+	if len(p.Payload) > 0 && string(p.Payload) != "null" {
+		task.Payload = p.Payload
+	}
+	for name := range p.Labels {
+		if name == "" {
+			return nil, invalidParams(*p.Id, "labels", "task label names must not be empty")
+		}
+	}
+	if len(p.Labels) > 0 {
+		task.Labels = p.Labels
+	}
+	if p.Priority != nil {
+		task.Priority = *p.Priority
+	}
+	task.TimeZone = timeZone
+	if p.TimeZone != nil {
+		task.TimeZone = *p.TimeZone
+	}
+	runAt := ""
+	if p.RunAt != nil {
+		runAt = string(*p.RunAt)
+	}
+	loc, err := LoadLocation(task.TimeZone)
+	if err != nil {
+		return nil, invalidTimeZone(task.Id, err)
+	}
+	now := time.Now().In(loc)
+	if runAt != "" {
+		if _, err := ParseRunAt(runAt, now); err != nil {
+			return nil, invalidRunAt(task.Id, "runAt", err)
+		}
+	}
+	if err := task.Schedule(runAt, now); err != nil {
+		field := "runAt"
+		if task.RRule != "" {
+			field = "rrule"
+		} else if task.Cron != "" {
+			field = "cron"
+		}
+		return nil, invalidRunAt(task.Id, field, err)
+	}
+	return task, nil
+}
+
+// InsertManyParams contains the rpc parameters for the InsertMany method.
+type InsertManyParams struct {
+	// Key is the timetable key.
+	// Tasks hold the named insert parameters of each task, the key
+	// parameter is ignored.
+	Key   *string         `json:"key"`
+	Tasks []*InsertParams `json:"tasks"`
+}
+
+// FromPositional parses the key and tasks from the positional
+// parameters.
+func (params *InsertManyParams) FromPositional(args []interface{}) error {
+	if len(args) != 2 {
+		return errors.New("key and tasks parameters are required")
+	}
+	key, ok := args[0].(string)
+	if !ok {
+		return errors.New("key must be a string")
+	}
+	data, err := json.Marshal(args[1])
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &params.Tasks); err != nil {
+		return err
+	}
+	params.Key = &key
+
+	return nil
+}
+
+// InsertMany adds the tasks to the timetable schedule and saves the
+// timetable once.  Either every task is inserted or none is.  The error
+// data of a failed call holds the error object of each failed task, or
+// null for the others, in the order of the tasks.  The call fails with
+// invalid params if any task is invalid, otherwise with the code of the
+// first task that cannot be inserted.
+func (api *ApiV1) InsertMany(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(InsertManyParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Key == nil {
+		return nil, invalidParams("", "key", "task key is required")
+	}
+	if len(p.Tasks) == 0 || len(p.Tasks) > MaxBatchSize {
+		return nil, invalidParams("", "tasks", fmt.Sprintf("tasks must hold 1 to %d tasks", MaxBatchSize))
+	}
+	timetable, timeZone, errObj := api.timetableZone(*p.Key)
+	if errObj != nil {
+		return nil, errObj
+	}
+	tasks := make([]*Task, len(p.Tasks))
+	errs := make([]interface{}, len(p.Tasks))
+	invalid := false
+	for i, params := range p.Tasks {
+		if params == nil {
+			errs[i], invalid = invalidParams("", "tasks", "task is required"), true
+			continue
+		}
+		task, errObj := api.newTask(timeZone, params)
+		if errObj != nil {
+			errs[i], invalid = errObj, true
+			continue
+		}
+		tasks[i] = task
+	}
+	if invalid {
 		return nil, &jrpc2.ErrorObject{
 			Code:    jrpc2.InvalidParamsCode,
 			Message: jrpc2.InvalidParamsMsg,
-			Data:    "task runAt is required",
+			Data:    errs,
 		}
 	}
 
-	var timetable *Timetable
-	var ok bool
-
-	if timetable, ok = api.timetables[*p.Key]; !ok {
-		timetable = NewTimetable(*p.Key)
-		api.timetables[*p.Key] = timetable
+	if timetable == nil {
+		timetable = api.register(NewTimetable(*p.Key))
 	}
-	if err := timetable.Insert(&Task{Id: *p.Id, RunAt: *p.RunAt}); err != nil {
-		return nil, &jrpc2.ErrorObject{
-			Code:    -32099,
-			Message: jrpc2.ServerErrorMsg,
-			Data:    err.Error(),
+	timetable.mu.Lock()
+	defer timetable.mu.Unlock()
+	return api.retry(timetable, func() (interface{}, *jrpc2.ErrorObject) {
+		errs := make([]interface{}, len(tasks))
+		inserted := make([]*Task, 0, len(tasks))
+		var failed *jrpc2.ErrorObject
+		for i, task := range tasks {
+			idempotent := p.Tasks[i].Idempotent != nil && *p.Tasks[i].Idempotent
+			if existing, ok := timetable.Lookup(task.Id); ok && idempotent && existing.Identical(task) {
+				continue
+			}
+			if err := timetable.Insert(task); err != nil {
+				errObj := taskError(timetable, task.Id, task.RunAt, err)
+				if failed == nil {
+					failed = errObj
+				}
+				errs[i] = errObj
+				continue
+			}
+			inserted = append(inserted, task)
+		}
+		if failed != nil {
+			for _, task := range inserted {
+				timetable.Remove(task.Id)
+			}
+			return nil, &jrpc2.ErrorObject{
+				Code:    failed.Code,
+				Message: failed.Message,
+				Data:    errs,
+			}
+		}
+		if len(inserted) == 0 {
+			return make([]int, len(tasks)), nil
 		}
+		if _, err := timetable.Save(api.model); err != nil {
+			log.Println(err)
+			for _, task := range inserted {
+				timetable.Remove(task.Id)
+			}
+			return nil, storageError(err)
+		}
+		return make([]int, len(tasks)), nil
+	})
+}
+
+// NackParams contains the rpc parameters for the Nack method.
+type NackParams struct {
+	// Key is the timetable key.
+	// Id is the id of the claimed task.
+	// LeaseToken is the token returned by claim.
+	// RetryAt is the point in time to run the task again.
+	Key        *string     `json:"key"`
+	Id         *string     `json:"id"`
+	LeaseToken *string     `json:"leaseToken"`
+	RetryAt    *RunAtParam `json:"retryAt"`
+}
+
+// FromPositional parses the key, id, leaseToken and optional retryAt
+// from the positional parameters.
+func (params *NackParams) FromPositional(args []interface{}) error {
+	if len(args) != 3 && len(args) != 4 {
+		return errors.New("key, id, and leaseToken parameters are required")
 	}
-	if _, err := timetable.Save(api.model); err != nil {
-		log.Println(err)
-		return nil, &jrpc2.ErrorObject{
-			Code:    -32099,
-			Message: jrpc2.ServerErrorMsg,
-			Data:    err.Error(),
+	key, ok := args[0].(string)
+	if !ok {
+		return errors.New("key must be a string")
+	}
+	id, ok := args[1].(string)
+	if !ok {
+		return errors.New("id must be a string")
+	}
+	token, ok := args[2].(string)
+	if !ok {
+		return errors.New("leaseToken must be a string")
+	}
+	params.Key = &key
+	params.Id = &id
+	params.LeaseToken = &token
+	if len(args) == 4 {
+		v, ok := runAtArg(args[3])
+		if !ok {
+			return errors.New("retryAt must be a string or a number")
 		}
+		retryAt := RunAtParam(v)
+		params.RetryAt = &retryAt
+	}
+
+	return nil
+}
+
+// Nack gives up a claimed task and returns it to the schedule.  The task
+// keeps its run at time unless retryAt is provided.
+func (api *ApiV1) Nack(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(NackParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Key == nil {
+		return nil, invalidParams("", "key", "task key is required")
+	}
+	if p.Id == nil {
+		return nil, invalidParams("", "id", "task id is required")
+	}
+	if p.LeaseToken == nil {
+		return nil, invalidParams("", "leaseToken", "lease token is required")
+	}
+	timetable, errObj := api.timetable(*p.Key)
+	if errObj != nil {
+		return nil, errObj
 	}
 
-	return 0, nil
+	timetable.mu.Lock()
+	defer timetable.mu.Unlock()
+	retryAt := ""
+	if p.RetryAt != nil {
+		loc, err := LoadLocation(timetable.TimeZone)
+		if err != nil {
+			return nil, invalidTimeZone(*p.Id, err)
+		}
+		if retryAt, err = NormalizeRunAt(string(*p.RetryAt), time.Now().In(loc)); err != nil {
+			return nil, invalidRunAt(*p.Id, "retryAt", err)
+		}
+	}
+	return api.retry(timetable, func() (interface{}, *jrpc2.ErrorObject) {
+		lease, err := timetable.Nack(*p.Id, *p.LeaseToken, retryAt)
+		if err != nil {
+			runAt := retryAt
+			if lease, ok := timetable.leases[*p.Id]; ok && runAt == "" {
+				runAt = lease.Task.RunAt
+			}
+			return nil, taskError(timetable, *p.Id, runAt, err)
+		}
+		if err := timetable.SaveTasks(api.model, lease.Task.Id); err != nil {
+			log.Println(err)
+			timetable.restoreLease(lease)
+			return nil, storageError(err)
+		}
+		return 0, nil
+	})
 }
 
 // NextParams contains the rpc parameters for the Next method.
@@ -217,27 +1259,107 @@ func (params *NextParams) FromPositional(args []interface{}) error {
 	return nil
 }
 
-// Next returns the next scheduled task from the timetable.
+// Next returns the next scheduled task from the timetable.  The removal
+// of the task is persisted before it is returned.
 func (api *ApiV1) Next(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
-	p := new(InsertParams)
+	p := new(NextParams)
 	if err := jrpc2.ParseParams(params, p); err != nil {
 		return nil, err
 	}
 	if p.Key == nil {
-		return nil, &jrpc2.ErrorObject{
-			Code:    jrpc2.InvalidParamsCode,
-			Message: jrpc2.InvalidParamsMsg,
-			Data:    "task key is required",
+		return nil, invalidParams("", "key", "task key is required")
+	}
+	timetable, errObj := api.timetable(*p.Key)
+	if errObj != nil {
+		return nil, errObj
+	}
+	timetable.mu.Lock()
+	defer timetable.mu.Unlock()
+	return api.next(timetable)
+}
+
+// next dequeues the next due task from the timetable and persists the
+// removal.  The caller must hold the timetable write lock.
+func (api *ApiV1) next(timetable *Timetable) (*Task, *jrpc2.ErrorObject) {
+	result, errObj := api.retry(timetable, func() (interface{}, *jrpc2.ErrorObject) {
+		task := timetable.Next()
+		if task == nil {
+			return nil, nil
 		}
+		if err := timetable.SaveTasks(api.model, task.Id); err != nil {
+			log.Println(err)
+			// put the task back so it is not lost when the dequeue could
+			// not be persisted.
+			timetable.restore(task)
+			return nil, storageError(err)
+		}
+		return task.view(), nil
+	})
+	task, _ := result.(*Task)
+	return task, errObj
+}
+
+// PreviewParams contains the rpc parameters for the Preview method.
+type PreviewParams struct {
+	// Key is the timetable key.
+	// Id is the id of the task.
+	// N is the number of occurrences to return.
+	Key *string `json:"key"`
+	Id  *string `json:"id"`
+	N   *int    `json:"n"`
+}
+
+// FromPositional parses the key, id and n from the positional parameters.
+func (params *PreviewParams) FromPositional(args []interface{}) error {
+	if len(args) != 3 {
+		return errors.New("key, id, and n parameters are required")
 	}
-	timetable, ok := api.timetables[*p.Key]
+	key, ok := args[0].(string)
 	if !ok {
-		return nil, &jrpc2.ErrorObject{
-			Code:    TimetableNotFoundCode,
-			Message: TimetableNotFoundMsg,
-		}
+		return errors.New("key must be a string")
+	}
+	id, ok := args[1].(string)
+	if !ok {
+		return errors.New("id must be a string")
+	}
+	n, ok := intArg(args[2])
+	if !ok {
+		return errors.New("n must be a number")
 	}
-	return timetable.Next(), nil
+	params.Key = &key
+	params.Id = &id
+	params.N = &n
+
+	return nil
+}
+
+// Preview returns the run at times of the next occurrences of a task.
+func (api *ApiV1) Preview(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(PreviewParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Key == nil {
+		return nil, invalidParams("", "key", "task key is required")
+	}
+	if p.Id == nil {
+		return nil, invalidParams("", "id", "task id is required")
+	}
+	if p.N == nil || *p.N < 1 || *p.N > MaxPreviewOccurrences {
+		return nil, invalidParams("", "n", fmt.Sprintf("n must be between 1 and %d", MaxPreviewOccurrences))
+	}
+	timetable, errObj := api.timetable(*p.Key)
+	if errObj != nil {
+		return nil, errObj
+	}
+
+	timetable.mu.RLock()
+	defer timetable.mu.RUnlock()
+	occurrences, err := timetable.Preview(*p.Id, *p.N)
+	if err != nil {
+		return nil, taskError(timetable, *p.Id, "", err)
+	}
+	return occurrences, nil
 }
 
 // RemoveParams contains the rpc parameters for the Remove method.
@@ -262,66 +1384,341 @@ func (params *RemoveParams) FromPositional(args []interface{}) error {
 	return nil
 }
 
-// Remove removes the task from the timetable
+// Remove removes the scheduled task from the timetable.  A task not
+// found error is returned if the task is not scheduled.
 func (api *ApiV1) Remove(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
 	p := new(RemoveParams)
 	if err := jrpc2.ParseParams(params, p); err != nil {
 		return nil, err
 	}
 	if p.Key == nil {
-		return nil, &jrpc2.ErrorObject{
-			Code:    jrpc2.InvalidParamsCode,
-			Message: jrpc2.InvalidParamsMsg,
-			Data:    "task key is required",
-		}
+		return nil, invalidParams("", "key", "task key is required")
 	}
 	if p.Id == nil {
-		return nil, &jrpc2.ErrorObject{
-			Code:    jrpc2.InvalidParamsCode,
-			Message: jrpc2.InvalidParamsMsg,
-			Data:    "task id is required",
+		return nil, invalidParams("", "id", "task id is required")
+	}
+
+	timetable, errObj := api.timetable(*p.Key)
+	if errObj != nil {
+		return nil, errObj
+	}
+
+	timetable.mu.Lock()
+	defer timetable.mu.Unlock()
+	return api.retry(timetable, func() (interface{}, *jrpc2.ErrorObject) {
+		task, ok := timetable.schedule.get(*p.Id)
+		if !ok {
+			return nil, taskError(timetable, *p.Id, "", ErrTaskNotFound)
+		}
+		timetable.Remove(*p.Id)
+		if err := timetable.SaveTasks(api.model, *p.Id); err != nil {
+			log.Println(err)
+			timetable.restore(task)
+			return nil, storageError(err)
+		}
+		return 0, nil
+	})
+}
+
+// RemoveManyParams contains the rpc parameters for the RemoveMany method.
+type RemoveManyParams struct {
+	// Key is the timetable key.
+	// Ids are the ids of the tasks to remove.
+	Key *string  `json:"key"`
+	Ids []string `json:"ids"`
+}
+
+// FromPositional parses the key and ids from the positional parameters.
+func (params *RemoveManyParams) FromPositional(args []interface{}) error {
+	if len(args) != 2 {
+		return errors.New("key and ids parameters are required")
+	}
+	key, ok := args[0].(string)
+	if !ok {
+		return errors.New("key must be a string")
+	}
+	ids, ok := args[1].([]interface{})
+	if !ok {
+		return errors.New("ids must be an array")
+	}
+	params.Key = &key
+	params.Ids = make([]string, len(ids))
+	for i, id := range ids {
+		s, ok := id.(string)
+		if !ok {
+			return errors.New("ids must be an array of strings")
 		}
+		params.Ids[i] = s
+	}
+
+	return nil
+}
+
+// RemoveMany removes the tasks from the timetable and saves the timetable
+// once.  The result holds 0 for each removed task and a task not found
+// error object for each task that is not scheduled, in the order of the
+// ids.
+func (api *ApiV1) RemoveMany(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(RemoveManyParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Key == nil {
+		return nil, invalidParams("", "key", "task key is required")
 	}
+	if len(p.Ids) == 0 || len(p.Ids) > MaxBatchSize {
+		return nil, invalidParams("", "ids", fmt.Sprintf("ids must hold 1 to %d task ids", MaxBatchSize))
+	}
+
+	timetable, errObj := api.timetable(*p.Key)
+	if errObj != nil {
+		return nil, errObj
+	}
+
+	timetable.mu.Lock()
+	defer timetable.mu.Unlock()
+	return api.retry(timetable, func() (interface{}, *jrpc2.ErrorObject) {
+		results := make([]interface{}, len(p.Ids))
+		removed := make([]*Task, 0, len(p.Ids))
+		for i, id := range p.Ids {
+			task, ok := timetable.schedule.get(id)
+			if !ok {
+				results[i] = taskError(timetable, id, "", ErrTaskNotFound)
+				continue
+			}
+			results[i] = 0
+			timetable.Remove(id)
+			removed = append(removed, task)
+		}
+		if len(removed) == 0 {
+			return results, nil
+		}
+		if _, err := timetable.Save(api.model); err != nil {
+			log.Println(err)
+			for _, task := range removed {
+				timetable.restore(task)
+			}
+			return nil, storageError(err)
+		}
+		return results, nil
+	})
+}
 
-	timetable, ok := api.timetables[*p.Key]
+// RescheduleParams contains the rpc parameters for the Reschedule method.
+type RescheduleParams struct {
+	// Key is the timetable key.
+	// Id is the id of the scheduled task.
+	// RunAt is the new execution point of time of the task.
+	// Payload is the optional new JSON document handed to the worker.
+	Key     *string         `json:"key"`
+	Id      *string         `json:"id"`
+	RunAt   *RunAtParam     `json:"runAt"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// FromPositional parses the key, id and runAt from the positional
+// parameters.
+func (params *RescheduleParams) FromPositional(args []interface{}) error {
+	if len(args) != 3 {
+		return errors.New("key, id, and runAt parameters are required")
+	}
+	key, ok := args[0].(string)
 	if !ok {
-		return nil, &jrpc2.ErrorObject{
-			Code:    TimetableNotFoundCode,
-			Message: TimetableNotFoundMsg,
+		return errors.New("key must be a string")
+	}
+	id, ok := args[1].(string)
+	if !ok {
+		return errors.New("id must be a string")
+	}
+	v, ok := runAtArg(args[2])
+	if !ok {
+		return errors.New("runAt must be a string or a number")
+	}
+	runAt := RunAtParam(v)
+	params.Key = &key
+	params.Id = &id
+	params.RunAt = &runAt
+
+	return nil
+}
+
+// Reschedule moves a scheduled task to another run at time and replaces
+// its payload if one is provided.  The run at time is read in the time
+// zone of the task.
+func (api *ApiV1) Reschedule(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(RescheduleParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Key == nil {
+		return nil, invalidParams("", "key", "task key is required")
+	}
+	if p.Id == nil {
+		return nil, invalidParams("", "id", "task id is required")
+	}
+	if p.RunAt == nil {
+		return nil, invalidParams("", "runAt", "run at is required")
+	}
+	if len(p.Payload) > api.MaxPayloadSize {
+		return nil, invalidParams("", "payload", fmt.Sprintf("task payload exceeds %d bytes", api.MaxPayloadSize))
+	}
+	var payload json.RawMessage
+	if len(p.Payload) > 0 && string(p.Payload) != "null" {
+		payload = p.Payload
+	}
+
+	timetable, errObj := api.timetable(*p.Key)
+	if errObj != nil {
+		return nil, errObj
+	}
+
+	timetable.mu.Lock()
+	defer timetable.mu.Unlock()
+	return api.retry(timetable, func() (interface{}, *jrpc2.ErrorObject) {
+		task, ok := timetable.schedule.get(*p.Id)
+		if !ok {
+			return nil, taskError(timetable, *p.Id, "", ErrTaskNotFound)
 		}
+		loc, err := LoadLocation(task.TimeZone)
+		if err != nil {
+			return nil, invalidTimeZone(*p.Id, err)
+		}
+		runAt, err := NormalizeRunAt(string(*p.RunAt), time.Now().In(loc))
+		if err != nil {
+			return nil, invalidRunAt(*p.Id, "runAt", err)
+		}
+		prev, err := timetable.Reschedule(*p.Id, runAt, payload)
+		if err != nil {
+			return nil, taskError(timetable, *p.Id, runAt, err)
+		}
+		if err := timetable.SaveTasks(api.model, *p.Id); err != nil {
+			log.Println(err)
+			timetable.restore(prev)
+			return nil, storageError(err)
+		}
+		return 0, nil
+	})
+}
+
+// WaitParams contains the rpc parameters for the Wait method.
+type WaitParams struct {
+	Key       *string `json:"key"`
+	TimeoutMs *int    `json:"timeoutMs"`
+}
+
+// FromPositional parses the key and timeoutMs positional parameters.
+func (params *WaitParams) FromPositional(args []interface{}) error {
+	if len(args) != 2 {
+		return errors.New("key and timeoutMs are required")
+	}
+	key, ok := args[0].(string)
+	if !ok {
+		return errors.New("key must be a string")
+	}
+	timeoutMs, ok := intArg(args[1])
+	if !ok {
+		return errors.New("timeoutMs must be a number")
 	}
+	params.Key = &key
+	params.TimeoutMs = &timeoutMs
 
-	if err := timetable.Remove(*p.Id); err != nil {
-		return -1, nil
+	return nil
+}
+
+// Wait blocks until the next scheduled task in the timetable is due and
+// returns it the same way Next does.  Null is returned if no task becomes
+// due before the timeout.
+func (api *ApiV1) Wait(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(WaitParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Key == nil {
+		return nil, invalidParams("", "key", "task key is required")
+	}
+	if p.TimeoutMs == nil || *p.TimeoutMs < 0 {
+		return nil, invalidParams("", "timeoutMs", "timeoutMs must be zero or greater")
+	}
+	timeout := time.Duration(*p.TimeoutMs) * time.Millisecond
+	if timeout > MaxWaitTimeout {
+		timeout = MaxWaitTimeout
+	}
+	timetable, errObj := api.timetable(*p.Key)
+	if errObj != nil {
+		return nil, errObj
 	}
-	if _, err := timetable.Save(api.model); err != nil {
-		return -1, &jrpc2.ErrorObject{
-			Code:    -32099,
-			Message: jrpc2.ServerErrorMsg,
-			Data:    err.Error(),
+	deadline := time.Now().Add(timeout)
+	for {
+		// refresh the timetable so tasks inserted by other replicas are
+		// seen.
+		if _, errObj := api.timetable(*p.Key); errObj != nil {
+			return nil, errObj
 		}
+		timetable.mu.Lock()
+		task, errObj := api.next(timetable)
+		if task != nil || errObj != nil {
+			timetable.mu.Unlock()
+			return task, errObj
+		}
+		changes := timetable.Changes()
+		wake := deadline
+		if at, ok := timetable.NextRunAt(); ok && at.Before(wake) {
+			// tasks are due once the current time is past their run
+			// at time.
+			wake = at.Add(time.Nanosecond)
+		}
+		if poll := time.Now().Add(api.CacheTTL); api.CacheTTL > 0 && poll.Before(wake) {
+			wake = poll
+		}
+		timetable.mu.Unlock()
+
+		if !time.Now().Before(deadline) {
+			return nil, nil
+		}
+		timer := time.NewTimer(time.Until(wake))
+		select {
+		case <-changes:
+		case <-timer.C:
+		}
+		timer.Stop()
 	}
-	return 0, nil
 }
 
 // NewApiV1 returns a new api version 1 rpc api instance
 func NewApiV1(model Model, s *jrpc2.Server) *ApiV1 {
-	api := &ApiV1{model, make(map[string]*Timetable)}
+	api := &ApiV1{
+		model:          model,
+		timetables:     make(map[string]*Timetable),
+		refreshed:      make(map[string]time.Time),
+		listed:         time.Now(),
+		MaxPayloadSize: DefaultMaxPayloadSize,
+		CacheTTL:       DefaultCacheTTL,
+	}
 	timetables, err := model.FetchAll()
 	if err != nil {
 		log.Fatal(err)
 	}
 	for _, timetable := range timetables {
 		v, _ := timetable.(*Timetable)
-		api.timetables[v.Key] = v
+		api.register(v)
 	}
 
+	s.Register("ack", jrpc2.Method{Method: api.Ack})
+	s.Register("claim", jrpc2.Method{Method: api.Claim})
+	s.Register("configure", jrpc2.Method{Method: api.Configure})
 	s.Register("delay", jrpc2.Method{Method: api.Delay})
+	s.Register("due", jrpc2.Method{Method: api.Due})
 	s.Register("get", jrpc2.Method{Method: api.Get})
 	s.Register("getAll", jrpc2.Method{Method: api.GetAll})
 	s.Register("insert", jrpc2.Method{Method: api.Insert})
+	s.Register("insertMany", jrpc2.Method{Method: api.InsertMany})
+	s.Register("nack", jrpc2.Method{Method: api.Nack})
 	s.Register("next", jrpc2.Method{Method: api.Next})
+	s.Register("preview", jrpc2.Method{Method: api.Preview})
 	s.Register("remove", jrpc2.Method{Method: api.Remove})
+	s.Register("removeMany", jrpc2.Method{Method: api.RemoveMany})
+	s.Register("reschedule", jrpc2.Method{Method: api.Reschedule})
+	s.Register("wait", jrpc2.Method{Method: api.Wait})
 
 	return api
 }
@@ -2,13 +2,320 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/bitwurx/jrpc2"
 )
 
+// RecordModel is a model that keeps the last saved document and fails
+// saves while err is set.
+type RecordModel struct {
+	MockModel
+	saved []byte
+	err   error
+}
+
+func (m *RecordModel) Save(table interface{}) (DocumentMeta, error) {
+	if m.err != nil {
+		return DocumentMeta{}, m.err
+	}
+	data, err := json.Marshal(table)
+	m.saved = data
+	return DocumentMeta{}, err
+}
+
+// TaskRecordModel is a task model that records the task operations it
+// receives.
+type TaskRecordModel struct {
+	RecordModel
+	ops []string
+}
+
+func (m *TaskRecordModel) InsertTask(key string, rev string, task *Task) (string, error) {
+	m.ops = append(m.ops, "insert "+key+" "+task.Id)
+	return "", m.err
+}
+
+func (m *TaskRecordModel) RemoveTask(key string, rev string, id string) (string, error) {
+	m.ops = append(m.ops, "remove "+key+" "+id)
+	return "", m.err
+}
+
+func (m *TaskRecordModel) ClaimTask(key string, rev string, lease *Lease) (string, error) {
+	m.ops = append(m.ops, "claim "+key+" "+lease.Task.Id)
+	return "", m.err
+}
+
+func TestApiV1TaskModel(t *testing.T) {
+	model := new(TaskRecordModel)
+	api := NewApiV1(model, jrpc2.NewServer("", ""))
+	calls := []string{
+		`{"key": "k", "id": "once", "runAt": "+0s"}`,
+		`{"key": "k", "id": "daily", "runAt": "+0s", "cron": "@daily"}`,
+		`{"key": "k", "id": "later", "runAt": "+1h"}`,
+	}
+	for _, params := range calls {
+		if _, errObj := api.Insert([]byte(params)); errObj != nil {
+			t.Fatal(errObj.Message)
+		}
+	}
+	if _, errObj := api.Next([]byte(`{"key": "k"}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	result, errObj := api.Claim([]byte(`{"key": "k", "workerId": "w1", "leaseSeconds": 60}`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	lease := result.(*Lease)
+	if _, errObj := api.Ack([]byte(fmt.Sprintf(`{"key": "k", "id": "daily", "leaseToken": "%s"}`, lease.Token))); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if _, errObj := api.Remove([]byte(`{"key": "k", "id": "later"}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	want := []string{
+		"insert k once", "insert k daily", "insert k later",
+		"remove k once", "claim k daily", "insert k daily", "remove k later",
+	}
+	if fmt.Sprint(model.ops) != fmt.Sprint(want) {
+		t.Fatalf("expected task operations %v, got %v", want, model.ops)
+	}
+	if model.saved != nil {
+		t.Fatal("expected the timetable not to be saved in full")
+	}
+
+	// the dequeue is rolled back when it cannot be persisted.
+	api.Insert([]byte(`{"key": "k", "id": "again", "runAt": "+0s"}`))
+	model.err = errors.New("unavailable")
+	if _, errObj := api.Next([]byte(`{"key": "k"}`)); errObj == nil {
+		t.Fatal("expected storage error")
+	}
+	model.err = nil
+	if result, _ := api.Next([]byte(`{"key": "k"}`)); result == nil || result.(*Task).Id != "again" {
+		t.Fatal("expected the task to be restored")
+	}
+}
+
+func TestApiV1ClaimAckNack(t *testing.T) {
+	api := NewApiV1(&MockModel{}, jrpc2.NewServer("", ""))
+	runAt := time.Now().Add(-time.Minute).Format(time.RFC3339)
+	if _, errObj := api.Insert([]byte(fmt.Sprintf(`{"key": "lease", "id": "abc123", "runAt": "%s"}`, runAt))); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if _, errObj := api.Claim([]byte(`{"key": "lease", "workerId": "w1", "leaseSeconds": 0}`)); errObj == nil {
+		t.Fatal("expected invalid params error")
+	}
+	for _, params := range []string{`["lease", "w1", "30"]`, `["lease", 1, 30]`} {
+		if _, errObj := api.Claim([]byte(params)); errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+			t.Fatalf("expected invalid params error for %s, got %v", params, errObj)
+		}
+	}
+	result, errObj := api.Claim([]byte(`{"key": "lease", "workerId": "w1", "leaseSeconds": 30}`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	lease := result.(*Lease)
+	if lease.Task.Id != "abc123" {
+		t.Fatal("expected task 'abc123' to be claimed")
+	}
+	for _, params := range []string{`["lease", "abc123", 1]`, `["lease", "abc123", "` + lease.Token + `", {"at": 1}]`} {
+		if _, errObj := api.Nack([]byte(params)); errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+			t.Fatalf("expected invalid params error for %s, got %v", params, errObj)
+		}
+	}
+	result, errObj = api.Nack([]byte(fmt.Sprintf(`["lease", "abc123", "%s"]`, lease.Token)))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	result, errObj = api.Claim([]byte(`["lease", "w2", 30]`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	lease = result.(*Lease)
+	if _, errObj := api.Nack([]byte(fmt.Sprintf(`{"key": "lease", "id": "abc123", "leaseToken": "%s", "retryAt": 1519907400}`, lease.Token))); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if task, _ := api.timetables["lease"].Lookup("abc123"); task == nil || task.RunAt != "2018-03-01T12:30:00Z" {
+		t.Fatalf("expected the task to be retried at the epoch, got %v", task)
+	}
+	result, errObj = api.Claim([]byte(`["lease", "w2", 30]`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	lease = result.(*Lease)
+	if _, errObj := api.Ack([]byte(`["lease", "abc123", null]`)); errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+		t.Fatalf("expected invalid params error, got %v", errObj)
+	}
+	if _, errObj := api.Ack([]byte(`{"key": "lease", "id": "abc123", "leaseToken": "bad"}`)); errObj == nil || errObj.Code != InvalidLeaseTokenCode {
+		t.Fatalf("expected invalid lease token error, got %v", errObj)
+	}
+	result, errObj = api.Ack([]byte(fmt.Sprintf(`{"key": "lease", "id": "abc123", "leaseToken": "%s"}`, lease.Token)))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if result != 0 {
+		t.Fatal("expected result to be 0")
+	}
+	if len(api.timetables["lease"].Leases()) != 0 || len(api.timetables["lease"].List()) != 0 {
+		t.Fatal("expected acknowledged task to be gone")
+	}
+}
+
+func TestApiV1ClaimUndo(t *testing.T) {
+	model := new(RecordModel)
+	api := NewApiV1(model, jrpc2.NewServer("", ""))
+	runAt := time.Now().Add(-time.Minute).Format(time.RFC3339)
+	if _, errObj := api.Insert([]byte(fmt.Sprintf(`{"key": "lease", "id": "abc123", "runAt": "%s"}`, runAt))); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	model.err = errors.New("connection refused")
+	if _, errObj := api.Claim([]byte(`["lease", "w1", 30]`)); errObj == nil || errObj.Code != StorageUnavailableCode {
+		t.Fatalf("expected storage unavailable error, got %v", errObj)
+	}
+	timetable := api.timetables["lease"]
+	if len(timetable.Leases()) != 0 || len(timetable.List()) != 1 {
+		t.Fatal("expected the unsaved claim to return the task to the schedule")
+	}
+
+	model.err = nil
+	if _, errObj := api.Claim([]byte(`["lease", "w1", 30]`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	expired := timetable.leases["abc123"]
+	expired.ExpiresAt = time.Time{}
+	model.err = errors.New("connection refused")
+	if _, errObj := api.Claim([]byte(`["lease", "w2", 30]`)); errObj == nil {
+		t.Fatal("expected storage unavailable error")
+	}
+	if leases := timetable.Leases(); len(leases) != 1 || leases[0] != expired || len(timetable.List()) != 0 {
+		t.Fatal("expected the unsaved claim to restore the expired lease")
+	}
+}
+
+func TestApiV1Configure(t *testing.T) {
+	api := NewApiV1(&MockModel{}, jrpc2.NewServer("", ""))
+	result, errObj := api.Configure([]byte(`{"key": "slot", "exclusive": true}`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if result != 0 {
+		t.Fatal("expected result to be 0")
+	}
+	runAt := time.Now().Format(time.RFC3339)
+	if _, errObj := api.Insert([]byte(fmt.Sprintf(`{"key": "slot", "id": "abc123", "runAt": "%s"}`, runAt))); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	_, errObj = api.Insert([]byte(fmt.Sprintf(`{"key": "slot", "id": "abc321", "runAt": "%s"}`, runAt)))
+	if errObj == nil || errObj.Code != ScheduleConflictCode {
+		t.Fatalf("expected schedule conflict error, got %v", errObj)
+	}
+	if data := errObj.Data.(*ErrorData); data.Id != "abc321" || data.Field != "runAt" || data.Task == nil || data.Task.Id != "abc123" {
+		t.Fatalf("expected the conflicting task in the error data, got %+v", data)
+	}
+	for _, params := range []string{`["slot", "false"]`, `["slot", false, 1]`} {
+		if _, errObj := api.Configure([]byte(params)); errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+			t.Fatalf("expected invalid params error for %s, got %v", params, errObj)
+		}
+	}
+	if _, errObj := api.Configure([]byte(`["slot", false]`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if _, errObj := api.Insert([]byte(fmt.Sprintf(`{"key": "slot", "id": "abc321", "runAt": "%s"}`, runAt))); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+}
+
+func TestApiV1ConfigurePriority(t *testing.T) {
+	api := NewApiV1(&MockModel{}, jrpc2.NewServer("", ""))
+	_, errObj := api.Configure([]byte(`{"key": "jobs", "order": "random"}`))
+	if errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+		t.Fatalf("expected invalid params error, got %v", errObj)
+	}
+	if data := errObj.Data.(*ErrorData); data.Field != "order" || data.Error == "" {
+		t.Fatalf("expected the offending field in the error data, got %+v", data)
+	}
+	_, errObj = api.Configure([]byte(`{"key": "jobs", "callback": {"url": "ftp://example.com"}}`))
+	if errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+		t.Fatalf("expected invalid params error, got %v", errObj)
+	}
+	if data := errObj.Data.(*ErrorData); data.Field != "callback" || data.Error == "" {
+		t.Fatalf("expected the offending field in the error data, got %+v", data)
+	}
+	_, errObj = api.Configure([]byte(`{"exclusive": true}`))
+	if errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+		t.Fatalf("expected invalid params error, got %v", errObj)
+	}
+	if data := errObj.Data.(*ErrorData); data.Field != "key" {
+		t.Fatalf("expected the missing field in the error data, got %+v", data)
+	}
+	if _, errObj := api.Configure([]byte(`{"key": "jobs", "order": "priority"}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	hourAgo := time.Now().Add(-time.Hour).Format(time.RFC3339)
+	minuteAgo := time.Now().Add(-time.Minute).Format(time.RFC3339)
+	calls := []string{
+		fmt.Sprintf(`{"key": "jobs", "id": "low", "runAt": "%s"}`, hourAgo),
+		fmt.Sprintf(`{"key": "jobs", "id": "high", "runAt": "%s", "priority": 10}`, minuteAgo),
+		fmt.Sprintf(`{"key": "jobs", "id": "claimed", "runAt": "%s", "priority": 5}`, minuteAgo),
+	}
+	for _, call := range calls {
+		if _, errObj := api.Insert([]byte(call)); errObj != nil {
+			t.Fatal(errObj.Message)
+		}
+	}
+	result, errObj := api.Get([]byte(`{"key": "jobs"}`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if data := string(result.(json.RawMessage)); !strings.Contains(data, `"priority":10`) || !strings.Contains(data, `"order":"priority"`) {
+		t.Fatalf("expected the priority and order to be exposed, got %s", data)
+	}
+	result, errObj = api.Next([]byte(`{"key": "jobs"}`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if task, ok := result.(*Task); !ok || task.Id != "high" {
+		t.Fatalf("expected task high, got %v", result)
+	}
+	result, errObj = api.Claim([]byte(`{"key": "jobs", "workerId": "w1", "leaseSeconds": 30}`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if lease, ok := result.(*Lease); !ok || lease.Task.Id != "claimed" {
+		t.Fatalf("expected task claimed to be leased, got %v", result)
+	}
+}
+
+func TestApiV1ConfigureTimeZone(t *testing.T) {
+	api := NewApiV1(&MockModel{}, jrpc2.NewServer("", ""))
+	_, errObj := api.Configure([]byte(`{"key": "tz", "timeZone": "Nowhere/Special"}`))
+	if errObj == nil || errObj.Code != InvalidTimeZoneCode {
+		t.Fatalf("expected invalid time zone error, got %v", errObj)
+	}
+	if data := errObj.Data.(*ErrorData); data.Field != "timeZone" || data.Error == "" {
+		t.Fatalf("expected the offending field in the error data, got %+v", data)
+	}
+	if _, errObj := api.Configure([]byte(`{"key": "tz", "timeZone": "Europe/Berlin"}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if _, errObj := api.Insert([]byte(`{"key": "tz", "id": "abc123", "runAt": "2018-07-01T09:00:00"}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	task := api.timetables["tz"].List()[0]
+	if task.RunAt != "2018-07-01T07:00:00Z" {
+		t.Fatalf("expected wall clock run at time in berlin, got %s", task.RunAt)
+	}
+	if task.TimeZone != "Europe/Berlin" {
+		t.Fatal("expected task to take the timetable time zone")
+	}
+}
+
 func TestApiV1Delay(t *testing.T) {
 	api := NewApiV1(&MockModel{}, jrpc2.NewServer("", ""))
 	runAt := time.Now().Add(time.Minute * 5).Format(time.RFC3339)
@@ -23,6 +330,58 @@ func TestApiV1Delay(t *testing.T) {
 	if result != 5 {
 		t.Fatal("expected delay to be 5")
 	}
+	api.Remove([]byte(`{"key": "delay", "id": "abc123"}`))
+	if _, errObj = api.Delay([]byte(`{"key": "delay"}`)); errObj == nil || errObj.Code != EmptyScheduleCode {
+		t.Fatalf("expected empty schedule error, got %v", errObj)
+	}
+}
+
+func TestApiV1Due(t *testing.T) {
+	api := NewApiV1(&MockModel{}, jrpc2.NewServer("", ""))
+	if _, errObj := api.Insert([]byte(`{"key": "due", "id": "soon", "runAt": "+10s"}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	result, errObj := api.Due([]byte(`{"key": "due"}`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	due := result.(*Due)
+	if ms := due.Delay.(int64); ms <= 9000 || ms > 10000 || due.Unit != "ms" || due.Overdue {
+		t.Fatalf("expected a delay of about 10000ms, got %v", due)
+	}
+	result, errObj = api.Due([]byte(`{"key": "due", "unit": "iso8601"}`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if due := result.(*Due); !strings.HasPrefix(due.Delay.(string), "PT9.") {
+		t.Fatalf("expected an iso 8601 delay of about 10 seconds, got %v", due.Delay)
+	}
+	if _, errObj = api.Due([]byte(`{"key": "due", "unit": "hours"}`)); errObj == nil {
+		t.Fatal("expected invalid params error")
+	}
+	for _, params := range []string{`["due", 1]`, `[1]`} {
+		if _, errObj := api.Due([]byte(params)); errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+			t.Fatalf("expected invalid params error for %s, got %v", params, errObj)
+		}
+	}
+
+	runAt := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	if _, errObj := api.Insert([]byte(fmt.Sprintf(`{"key": "due", "id": "late", "runAt": "%s"}`, runAt))); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	result, errObj = api.Due([]byte(`{"key": "due", "unit": "s"}`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if due := result.(*Due); !due.Overdue || due.Delay != 0.0 || due.RunAt != runAt {
+		t.Fatalf("expected overdue task at %s, got %v", runAt, due)
+	}
+
+	api.Remove([]byte(`{"key": "due", "id": "soon"}`))
+	api.Remove([]byte(`{"key": "due", "id": "late"}`))
+	if _, errObj = api.Due([]byte(`{"key": "due"}`)); errObj == nil || errObj.Code != EmptyScheduleCode {
+		t.Fatalf("expected empty schedule error, got %v", errObj)
+	}
 }
 
 func TestApiV1Get(t *testing.T) {
@@ -52,13 +411,87 @@ func TestApiV1Get(t *testing.T) {
 	}
 }
 
+func TestApiV1GetLeaseToken(t *testing.T) {
+	api := NewApiV1(&MockModel{}, jrpc2.NewServer("", ""))
+	if _, errObj := api.Insert([]byte(`{"key": "get", "id": "abc123", "runAt": "+0s"}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	result, errObj := api.Claim([]byte(`{"key": "get", "workerId": "w1", "leaseSeconds": 60}`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	token := result.(*Lease).Token
+	for _, get := range []func(json.RawMessage) (interface{}, *jrpc2.ErrorObject){api.Get, api.GetAll} {
+		result, errObj := get([]byte(`{"key": "get"}`))
+		if errObj != nil {
+			t.Fatal(errObj.Message)
+		}
+		data, err := json.Marshal(result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), `"workerId":"w1"`) || strings.Contains(string(data), token) {
+			t.Fatalf("expected the lease without its token, got %s", data)
+		}
+	}
+	if _, errObj := api.Ack([]byte(fmt.Sprintf(`{"key": "get", "id": "abc123", "leaseToken": "%s"}`, token))); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+}
+
+func TestApiV1GetCallbackHeaders(t *testing.T) {
+	model := new(RecordModel)
+	api := NewApiV1(model, jrpc2.NewServer("", ""))
+	if _, errObj := api.Configure([]byte(`{"key": "get", "callback": {"url": "http://example.com", "headers": {"Authorization": "Bearer table"}}}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	calls := []string{
+		`{"key": "get", "id": "a", "runAt": "+1h", "callback": {"url": "http://example.com", "headers": {"X-Token": "scheduled"}}}`,
+		`{"key": "get", "id": "b", "runAt": "+0s", "callback": {"url": "http://example.com", "headers": {"X-Token": "leased"}}}`,
+	}
+	for _, call := range calls {
+		if _, errObj := api.Insert([]byte(call)); errObj != nil {
+			t.Fatal(errObj.Message)
+		}
+	}
+	time.Sleep(time.Millisecond * 2)
+	result, errObj := api.Claim([]byte(`["get", "w1", 60]`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if headers := result.(*Lease).Task.Callback.Headers; headers["X-Token"] != RedactedHeader {
+		t.Fatalf("expected the claimed task headers to be redacted, got %v", headers)
+	}
+	for _, get := range []func(json.RawMessage) (interface{}, *jrpc2.ErrorObject){api.Get, api.GetAll} {
+		result, errObj := get([]byte(`{"key": "get"}`))
+		if errObj != nil {
+			t.Fatal(errObj.Message)
+		}
+		data, err := json.Marshal(result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, secret := range []string{"Bearer table", "scheduled", "leased"} {
+			if strings.Contains(string(data), secret) {
+				t.Fatalf("expected the callback headers to be redacted, got %s", data)
+			}
+		}
+		if !strings.Contains(string(data), `"X-Token":"`+RedactedHeader+`"`) {
+			t.Fatalf("expected the redacted header names to be listed, got %s", data)
+		}
+	}
+	if !strings.Contains(string(model.saved), "Bearer table") || !strings.Contains(string(model.saved), "leased") {
+		t.Fatal("expected the stored callback headers to be kept")
+	}
+}
+
 func TestApiV1GetAll(t *testing.T) {
 	api := NewApiV1(&MockModel{}, jrpc2.NewServer("", ""))
-	_, errObj := api.Insert([]byte(fmt.Sprintf(`{"key": "k1", "id": "abc123", "runAt": "%s"}`, time.Now().String())))
+	_, errObj := api.Insert([]byte(fmt.Sprintf(`{"key": "k1", "id": "abc123", "runAt": "%s"}`, time.Now().Format(time.RFC3339))))
 	if errObj != nil {
 		t.Fatal(errObj.Message)
 	}
-	_, errObj = api.Insert([]byte(fmt.Sprintf(`{"key": "k2", "id": "abc123", "runAt": "%s"}`, time.Now().String())))
+	_, errObj = api.Insert([]byte(fmt.Sprintf(`{"key": "k2", "id": "abc123", "runAt": "%s"}`, time.Now().Format(time.RFC3339))))
 	if errObj != nil {
 		t.Fatal(errObj.Message)
 	}
@@ -97,54 +530,878 @@ func TestApiV1Insert(t *testing.T) {
 	}
 }
 
-func TestApiV1Next(t *testing.T) {
+func TestApiV1InsertRunAt(t *testing.T) {
 	api := NewApiV1(&MockModel{}, jrpc2.NewServer("", ""))
-	now := time.Now()
-	_, errObj := api.Insert([]byte(fmt.Sprintf(`{"key": "k3", "id": "abc123", "runAt": "%s"}`, now.Format(time.RFC3339))))
-	if errObj != nil {
+	_, errObj := api.Insert([]byte(fmt.Sprintf(`{"key": "runAt", "id": "abc123", "runAt": "%s"}`, time.Now().String())))
+	if errObj == nil || errObj.Code != InvalidRunAtCode {
+		t.Fatalf("expected invalid run at error, got %v", errObj)
+	}
+	if data := errObj.Data.(*ErrorData); data.Id != "abc123" || data.Field != "runAt" {
+		t.Fatalf("expected the offending field in the error data, got %+v", data)
+	}
+	if _, errObj := api.Insert([]byte(`{"key": "runAt", "id": "abc123", "runAt": "+15m"}`)); errObj != nil {
 		t.Fatal(errObj.Message)
 	}
-	_, errObj = api.Insert([]byte(fmt.Sprintf(`{"key": "k3", "id": "abc123", "runAt": "%s"}`, now.Add(time.Minute*5).Format(time.RFC3339))))
-	if errObj != nil {
+	if _, errObj := api.Insert([]byte(`["runAt", "abc321", 1519907400]`)); errObj != nil {
 		t.Fatal(errObj.Message)
 	}
-	result, err := api.Next([]byte(fmt.Sprintf(`{"key": "k3"}`)))
+	tasks := api.timetables["runAt"].List()
+	if tasks[0].RunAt != "2018-03-01T12:30:00Z" {
+		t.Fatalf("expected normalized epoch run at time, got %s", tasks[0].RunAt)
+	}
+	runAt, err := time.Parse(time.RFC3339, tasks[1].RunAt)
 	if err != nil {
 		t.Fatal(err)
 	}
-	task := result.(*Task)
-	if task.RunAt == now.String() {
-		t.Fatal("expected run at time to be %s, got %s", task.RunAt, now.String())
+	if d := time.Until(runAt); d < time.Minute*14 || d > time.Minute*15 {
+		t.Fatal("expected relative run at time to be 15 minutes from now")
+	}
+
+	if _, errObj := api.Insert([]byte(`{"key": "runAt", "id": "named", "runAt": 1519907460000}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if task, _ := api.timetables["runAt"].Lookup("named"); task == nil || task.RunAt != "2018-03-01T12:31:00Z" {
+		t.Fatalf("expected the named epoch run at time to be accepted, got %v", task)
+	}
+	for _, params := range []string{
+		`["runAt", "bad", {"at": 1}]`,
+		`["runAt", "bad", null]`,
+		`["runAt", "bad", "+1h", 5]`,
+		`{"key": "runAt", "id": "bad", "runAt": true}`,
+	} {
+		if _, errObj := api.Insert([]byte(params)); errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+			t.Fatalf("%s: expected invalid params error, got %v", params, errObj)
+		}
 	}
 }
 
-func TestApiV1Remove(t *testing.T) {
+func TestApiV1InsertPayload(t *testing.T) {
 	api := NewApiV1(&MockModel{}, jrpc2.NewServer("", ""))
-	runAt := time.Now().String()
-	result, errObj := api.Insert([]byte(fmt.Sprintf(`{"key": "test1", "id": "abc321", "runAt": "%s"}`, runAt)))
+	payload := `{"action":"email","to":["a@example.com","b@example.com"],"retry":{"max":3,"ratio":1.5},"note":"caf\u00e9 \"quoted\""}`
+	params := fmt.Sprintf(`{"key": "payload", "id": "abc123", "runAt": "+0s", "payload": %s, "labels": {"team": "mail", "env": "prod"}}`, payload)
+	if _, errObj := api.Insert([]byte(params)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	result, errObj := api.Get([]byte(`{"key": "payload"}`))
 	if errObj != nil {
-		t.Fatal(errObj)
+		t.Fatal(errObj.Message)
 	}
-	if result != 0 {
-		t.Fatal("expected result to be 0")
+	table := new(Timetable)
+	if err := json.Unmarshal(result.(json.RawMessage), table); err != nil {
+		t.Fatal(err)
+	}
+	if task := table.List()[0]; string(task.Payload) != payload || task.Labels["team"] != "mail" || task.Labels["env"] != "prod" {
+		t.Fatalf("expected payload and labels to be returned by get, got %s %v", task.Payload, task.Labels)
 	}
-	result, errObj = api.Remove([]byte(`{"key": "test1", "id": "9g49g44"}`))
+	result, errObj = api.Next([]byte(`{"key": "payload"}`))
 	if errObj != nil {
 		t.Fatal(errObj.Message)
 	}
-	if result != -1 {
-		t.Fatal("expected result to be -1")
+	if task := result.(*Task); string(task.Payload) != payload || len(task.Labels) != 2 {
+		t.Fatalf("expected payload and labels to be returned by next, got %s %v", task.Payload, task.Labels)
 	}
-	result, errObj = api.Remove([]byte(fmt.Sprintf(`{"key": "test1", "id": "abc321"}`)))
+
+	api.MaxPayloadSize = 16
+	params = `{"key": "payload", "id": "big", "runAt": "+0s", "payload": {"data": "more than sixteen bytes"}}`
+	if _, errObj := api.Insert([]byte(params)); errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+		t.Fatal("expected payload size error")
+	}
+	params = `{"key": "payload", "id": "label", "runAt": "+0s", "labels": {"": "empty"}}`
+	if _, errObj := api.Insert([]byte(params)); errObj == nil {
+		t.Fatal("expected label name error")
+	}
+}
+
+func TestApiV1InsertIdempotent(t *testing.T) {
+	model := new(TaskRecordModel)
+	api := NewApiV1(model, jrpc2.NewServer("", ""))
+	insert := `{"key": "jobs", "id": "a", "runAt": "2030-01-01T09:00:00Z", "payload": {"n": 1}, "idempotent": true}`
+	if _, errObj := api.Insert([]byte(insert)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	result, errObj := api.Insert([]byte(insert))
 	if errObj != nil {
 		t.Fatal(errObj.Message)
 	}
 	if result != 0 {
 		t.Fatal("expected result to be 0")
 	}
-	for _, task := range api.timetables["test1"].List() {
-		if task.Id == "abc321" {
-			t.Fatal("expected task with id 'abc321' to be removed")
+	if len(model.ops) != 1 {
+		t.Fatalf("expected the repeated insert not to be written, got %v", model.ops)
+	}
+
+	conflicts := []string{
+		`{"key": "jobs", "id": "a", "runAt": "2030-01-01T09:00:00Z", "payload": {"n": 1}}`,
+		`{"key": "jobs", "id": "a", "runAt": "2030-01-01T10:00:00Z", "payload": {"n": 1}, "idempotent": true}`,
+		`{"key": "jobs", "id": "a", "runAt": "2030-01-01T09:00:00Z", "payload": {"n": 2}, "idempotent": true}`,
+	}
+	for _, conflict := range conflicts {
+		_, errObj := api.Insert([]byte(conflict))
+		if errObj == nil || errObj.Code != DuplicateTaskCode {
+			t.Fatalf("expected duplicate task error for %s, got %v", conflict, errObj)
+		}
+		if data := errObj.Data.(*ErrorData); data.Id != "a" || data.Task == nil || data.Task.RunAt != "2030-01-01T09:00:00Z" {
+			t.Fatalf("expected the existing task in the error data, got %+v", data)
+		}
+	}
+	timetable, _ := api.timetable("jobs")
+	if tasks := timetable.List(); len(tasks) != 1 {
+		t.Fatalf("expected 1 task, got %d", len(tasks))
+	}
+}
+
+// FetchCountModel is a model that counts the single timetable reads of
+// the wrapped model.
+type FetchCountModel struct {
+	Model
+	fetches int
+}
+
+func (m *FetchCountModel) Fetch(key string) (interface{}, error) {
+	m.fetches++
+	return m.Model.Fetch(key)
+}
+
+func TestApiV1InsertManyFetch(t *testing.T) {
+	model := &FetchCountModel{Model: MockModel{}}
+	api := NewApiV1(model, jrpc2.NewServer("", ""))
+	tasks := `[{"id": "a", "runAt": "+1h"}, {"id": "b", "runAt": "+1h"}, {"id": "c", "runAt": "+1h"}, {"id": "d", "runAt": "+1h"}]`
+	if _, errObj := api.InsertMany([]byte(`{"key": "k", "tasks": ` + tasks + `}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if model.fetches != 1 {
+		t.Fatalf("expected the new timetable to be read once, got %d reads", model.fetches)
+	}
+}
+
+func TestApiV1ListRefresh(t *testing.T) {
+	model := &FetchCountModel{Model: NewMemoryModel()}
+	a := NewApiV1(model, jrpc2.NewServer("", ""))
+	b := NewApiV1(model, jrpc2.NewServer("", ""))
+	a.CacheTTL, b.CacheTTL = 0, 0
+	for _, call := range []string{`{"key": "k1", "id": "x", "runAt": "+1h"}`, `{"key": "k2", "id": "y", "runAt": "+1h"}`} {
+		if _, errObj := a.Insert([]byte(call)); errObj != nil {
+			t.Fatal(errObj.Message)
+		}
+	}
+	if _, errObj := b.GetAll(nil); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if _, errObj := a.Insert([]byte(`{"key": "k1", "id": "z", "runAt": "+1h"}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	model.fetches = 0
+	result, errObj := b.GetAll(nil)
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if timetables := result.([]json.RawMessage); len(timetables) != 2 {
+		t.Fatalf("expected 2 timetables, got %d", len(timetables))
+	}
+	if tasks := b.timetables["k1"].List(); len(tasks) != 2 {
+		t.Fatalf("expected the listing to refresh the timetable, got %d tasks", len(tasks))
+	}
+	if model.fetches != 0 {
+		t.Fatalf("expected the listing to read the timetables once, got %d more reads", model.fetches)
+	}
+}
+
+func TestApiV1InsertMany(t *testing.T) {
+	model := new(TaskRecordModel)
+	api := NewApiV1(model, jrpc2.NewServer("", ""))
+	result, errObj := api.InsertMany([]byte(`{"key": "seed", "tasks": [
+		{"id": "a", "runAt": "+1h"},
+		{"id": "b", "runAt": "+2h", "priority": 2},
+		{"id": "c", "runAt": "+3h", "cron": "@daily"}
+	]}`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if results := result.([]int); len(results) != 3 || results[0] != 0 || results[2] != 0 {
+		t.Fatalf("expected 3 results of 0, got %v", result)
+	}
+	if len(model.ops) != 0 || !strings.Contains(string(model.saved), `"_key":"c"`) {
+		t.Fatal("expected the timetable to be saved once")
+	}
+
+	// an invalid or conflicting task rejects the whole batch.
+	_, errObj = api.InsertMany([]byte(`{"key": "seed", "tasks": [{"id": "d", "runAt": "+1h"}, {"id": "e", "runAt": "soon"}]}`))
+	if errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+		t.Fatal("expected invalid params error")
+	}
+	if errs := errObj.Data.([]interface{}); errs[0] != nil || errs[1] == nil {
+		t.Fatalf("expected an error for the second task only, got %v", errs)
+	}
+	_, errObj = api.InsertMany([]byte(`["seed", [{"id": "d", "runAt": "+1h"}, {"id": "a", "runAt": "+1h"}]]`))
+	if errObj == nil || errObj.Code != DuplicateTaskCode {
+		t.Fatalf("expected task id conflict error, got %v", errObj)
+	}
+	if errs := errObj.Data.([]interface{}); errs[0] != nil || errs[1].(*jrpc2.ErrorObject).Code != DuplicateTaskCode {
+		t.Fatalf("expected a duplicate task error for the second task only, got %v", errs)
+	}
+	if _, errObj := api.InsertMany([]byte(`{"key": "seed", "tasks": []}`)); errObj == nil {
+		t.Fatal("expected tasks required error")
+	}
+	timetable, _ := api.timetable("seed")
+	if tasks := timetable.List(); len(tasks) != 3 {
+		t.Fatalf("expected 3 tasks, got %d", len(tasks))
+	}
+}
+
+func TestApiV1InsertCron(t *testing.T) {
+	api := NewApiV1(&MockModel{}, jrpc2.NewServer("", ""))
+	if _, errObj := api.Insert([]byte(`{"key": "cron", "id": "abc123", "cron": "not a cron"}`)); errObj == nil {
+		t.Fatal("expected invalid params error")
+	}
+	if _, errObj := api.Insert([]byte(`{"key": "cron", "id": "abc123"}`)); errObj == nil {
+		t.Fatal("expected invalid params error")
+	}
+	if _, errObj := api.Insert([]byte(`{"key": "cron", "id": "abc123", "cron": "@hourly", "timeZone": "Asia/Kolkata"}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	task := api.timetables["cron"].List()[0]
+	at, err := time.Parse(time.RFC3339, task.RunAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !at.After(time.Now()) || at.In(time.FixedZone("IST", 19800)).Minute() != 0 {
+		t.Fatalf("expected first occurrence at the top of the hour, got %s", task.RunAt)
+	}
+}
+
+func TestApiV1Next(t *testing.T) {
+	api := NewApiV1(&MockModel{}, jrpc2.NewServer("", ""))
+	now := time.Now()
+	_, errObj := api.Insert([]byte(fmt.Sprintf(`{"key": "k3", "id": "abc123", "runAt": "%s"}`, now.Format(time.RFC3339))))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	_, errObj = api.Insert([]byte(fmt.Sprintf(`{"key": "k3", "id": "abc321", "runAt": "%s"}`, now.Add(time.Minute*5).Format(time.RFC3339))))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	result, err := api.Next([]byte(fmt.Sprintf(`{"key": "k3"}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	task := result.(*Task)
+	if task.RunAt == now.String() {
+		t.Fatalf("expected run at time to be %s, got %s", task.RunAt, now.String())
+	}
+}
+
+func TestApiV1NextPersists(t *testing.T) {
+	model := &RecordModel{}
+	api := NewApiV1(model, jrpc2.NewServer("", ""))
+	runAt := time.Now().Add(-time.Minute).Format(time.RFC3339)
+	if _, errObj := api.Insert([]byte(fmt.Sprintf(`{"key": "k4", "id": "abc123", "runAt": "%s"}`, runAt))); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	model.err = errors.New("unavailable")
+	if _, errObj := api.Next([]byte(`{"key": "k4"}`)); errObj == nil {
+		t.Fatal("expected save error")
+	}
+	if len(api.timetables["k4"].List()) != 1 {
+		t.Fatal("expected task to be put back on save failure")
+	}
+	model.err = nil
+	result, errObj := api.Next([]byte(`{"key": "k4"}`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if result.(*Task).Id != "abc123" {
+		t.Fatal("expected task 'abc123'")
+	}
+	timetable := new(Timetable)
+	if err := json.Unmarshal(model.saved, timetable); err != nil {
+		t.Fatal(err)
+	}
+	if len(timetable.List()) != 0 {
+		t.Fatal("expected dequeued task to be removed from the saved timetable")
+	}
+}
+
+func TestApiV1Preview(t *testing.T) {
+	api := NewApiV1(&MockModel{}, jrpc2.NewServer("", ""))
+	_, errObj := api.Insert([]byte(`{"key": "preview", "id": "abc123", "runAt": "2018-03-01T09:00:00Z", "rrule": "FREQ=MINUTELY;INTERVAL=90"}`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if _, errObj := api.Preview([]byte(`{"key": "preview", "id": "abc123", "n": 0}`)); errObj == nil {
+		t.Fatal("expected invalid params error")
+	}
+	for _, params := range []string{`["preview", "abc123", "3"]`, `["preview", 1, 3]`} {
+		if _, errObj := api.Preview([]byte(params)); errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+			t.Fatalf("expected invalid params error for %s, got %v", params, errObj)
+		}
+	}
+	if _, errObj := api.Preview([]byte(`{"key": "preview", "id": "missing", "n": 3}`)); errObj == nil {
+		t.Fatal("expected not found error")
+	}
+	result, errObj := api.Preview([]byte(`["preview", "abc123", 3]`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	occurrences := result.([]string)
+	want := []string{"2018-03-01T09:00:00Z", "2018-03-01T10:30:00Z", "2018-03-01T12:00:00Z"}
+	for i := range want {
+		if occurrences[i] != want[i] {
+			t.Fatalf("expected occurrence %s, got %s", want[i], occurrences[i])
+		}
+	}
+}
+
+func TestApiV1Remove(t *testing.T) {
+	api := NewApiV1(&MockModel{}, jrpc2.NewServer("", ""))
+	runAt := time.Now().Format(time.RFC3339)
+	result, errObj := api.Insert([]byte(fmt.Sprintf(`{"key": "test1", "id": "abc321", "runAt": "%s"}`, runAt)))
+	if errObj != nil {
+		t.Fatal(errObj)
+	}
+	if result != 0 {
+		t.Fatal("expected result to be 0")
+	}
+	_, errObj = api.Remove([]byte(`{"key": "test1", "id": "9g49g44"}`))
+	if errObj == nil || errObj.Code != TaskNotFoundCode {
+		t.Fatalf("expected task not found error, got %v", errObj)
+	}
+	if data := errObj.Data.(*ErrorData); data.Id != "9g49g44" {
+		t.Fatalf("expected the task id in the error data, got %+v", data)
+	}
+	result, errObj = api.Remove([]byte(fmt.Sprintf(`{"key": "test1", "id": "abc321"}`)))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if result != 0 {
+		t.Fatal("expected result to be 0")
+	}
+	for _, task := range api.timetables["test1"].List() {
+		if task.Id == "abc321" {
+			t.Fatal("expected task with id 'abc321' to be removed")
+		}
+	}
+}
+
+func TestApiV1RemoveMany(t *testing.T) {
+	model := new(RecordModel)
+	api := NewApiV1(model, jrpc2.NewServer("", ""))
+	if _, errObj := api.RemoveMany([]byte(`{"key": "seed", "ids": ["a"]}`)); errObj == nil {
+		t.Fatal("expected timetable not found error")
+	}
+	if _, errObj := api.InsertMany([]byte(`{"key": "seed", "tasks": [{"id": "a", "runAt": "+1h"}, {"id": "b", "runAt": "+2h"}, {"id": "c", "runAt": "+3h"}]}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	for _, params := range []string{`[1, ["a"]]`, `[null, ["a"]]`} {
+		if _, errObj := api.RemoveMany([]byte(params)); errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+			t.Fatalf("expected invalid params error for %s, got %v", params, errObj)
+		}
+		if _, errObj := api.InsertMany([]byte(params)); errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+			t.Fatalf("expected invalid params error for %s, got %v", params, errObj)
+		}
+	}
+	if _, errObj := api.RemoveMany([]byte(`["seed", ["a", 1]]`)); errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+		t.Fatalf("expected invalid params error, got %v", errObj)
+	}
+	result, errObj := api.RemoveMany([]byte(`["seed", ["a", "missing", "c"]]`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	results := result.([]interface{})
+	if len(results) != 3 || results[0] != 0 || results[2] != 0 {
+		t.Fatalf("expected the removed tasks to return 0, got %v", result)
+	}
+	if errObj, ok := results[1].(*jrpc2.ErrorObject); !ok || errObj.Code != TaskNotFoundCode || errObj.Data.(*ErrorData).Id != "missing" {
+		t.Fatalf("expected a task not found error for the missing task, got %v", results[1])
+	}
+	timetable, _ := api.timetable("seed")
+	if tasks := timetable.List(); len(tasks) != 1 || tasks[0].Id != "b" {
+		t.Fatal("expected only task b to be scheduled")
+	}
+
+	// the tasks are restored when the save fails.
+	model.err = errors.New("unavailable")
+	if _, errObj := api.RemoveMany([]byte(`{"key": "seed", "ids": ["b"]}`)); errObj == nil {
+		t.Fatal("expected save error")
+	}
+	if tasks := timetable.List(); len(tasks) != 1 || tasks[0].Id != "b" {
+		t.Fatal("expected task b to be restored")
+	}
+}
+
+// testApiV1Replicas runs two replicas of the api against the shared
+// model.
+func testApiV1Replicas(t *testing.T, model Model) {
+	a := NewApiV1(model, jrpc2.NewServer("", ""))
+	b := NewApiV1(model, jrpc2.NewServer("", ""))
+	a.CacheTTL, b.CacheTTL = 0, 0
+
+	if _, errObj := a.Insert([]byte(`{"key": "k", "id": "x", "runAt": "+0s"}`)); errObj != nil {
+		t.Fatal(errObj)
+	}
+	if _, errObj := b.Get([]byte(`{"key": "k"}`)); errObj != nil {
+		t.Fatalf("expected the timetable inserted by the other replica, got %v", errObj)
+	}
+	if _, errObj := a.Configure([]byte(`{"key": "other", "exclusive": true}`)); errObj != nil {
+		t.Fatal(errObj)
+	}
+	result, errObj := b.GetAll(nil)
+	if errObj != nil {
+		t.Fatal(errObj)
+	}
+	if timetables := result.([]json.RawMessage); len(timetables) != 2 {
+		t.Fatalf("expected 2 timetables, got %d", len(timetables))
+	}
+
+	result, errObj = b.Next([]byte(`{"key": "k"}`))
+	if errObj != nil {
+		t.Fatal(errObj)
+	}
+	if task, ok := result.(*Task); !ok || task.Id != "x" {
+		t.Fatalf("expected task x, got %v", result)
+	}
+	result, errObj = a.Next([]byte(`{"key": "k"}`))
+	if errObj != nil {
+		t.Fatal(errObj)
+	}
+	if task, ok := result.(*Task); ok && task != nil {
+		t.Fatalf("expected the task to be handed out once, got %v", task)
+	}
+
+	// a waiter polls the model for tasks inserted by the other replica.
+	b.CacheTTL = time.Millisecond * 10
+	waiter := wait(t, b, `{"key": "k", "timeoutMs": 5000}`)
+	if _, errObj := a.Insert([]byte(`{"key": "k", "id": "y", "runAt": "+0s"}`)); errObj != nil {
+		t.Fatal(errObj)
+	}
+	if task := <-waiter; task == nil || task.Id != "y" {
+		t.Fatalf("expected task y, got %v", task)
+	}
+}
+
+func TestApiV1ReplicasMemory(t *testing.T) {
+	testApiV1Replicas(t, NewMemoryModel())
+}
+
+func TestApiV1ReplicasSQL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "timetables.db")
+	model := newTestSQLModel(t, path)
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	testApiV1Replicas(t, model)
+
+	// replicas serving stale timetables do not overwrite each other's
+	// task writes.
+	a := NewApiV1(newTestSQLModel(t, path), jrpc2.NewServer("", ""))
+	b := NewApiV1(newTestSQLModel(t, path), jrpc2.NewServer("", ""))
+	a.CacheTTL, b.CacheTTL = time.Hour, time.Hour
+	if _, errObj := a.Insert([]byte(`{"key": "stale", "id": "due", "runAt": "+0s"}`)); errObj != nil {
+		t.Fatal(errObj)
+	}
+	if _, errObj := b.Get([]byte(`{"key": "stale"}`)); errObj != nil {
+		t.Fatal(errObj)
+	}
+	result, errObj := a.Claim([]byte(`{"key": "stale", "workerId": "w1", "leaseSeconds": 60}`))
+	if errObj != nil {
+		t.Fatal(errObj)
+	}
+	if lease, ok := result.(*Lease); !ok || lease.Task.Id != "due" {
+		t.Fatalf("expected task due to be claimed, got %v", result)
+	}
+	result, errObj = b.Claim([]byte(`{"key": "stale", "workerId": "w2", "leaseSeconds": 60}`))
+	if errObj != nil {
+		t.Fatal(errObj)
+	}
+	if lease, ok := result.(*Lease); ok && lease != nil {
+		t.Fatalf("expected the task to be claimed once, got %v", lease)
+	}
+	if _, errObj := a.Insert([]byte(`{"key": "stale", "id": "x", "runAt": "+1h"}`)); errObj != nil {
+		t.Fatal(errObj)
+	}
+	if _, errObj := b.Insert([]byte(`{"key": "stale", "id": "y", "runAt": "+1h"}`)); errObj != nil {
+		t.Fatal(errObj)
+	}
+	if _, errObj := a.Remove([]byte(`{"key": "stale", "id": "x"}`)); errObj != nil {
+		t.Fatal(errObj)
+	}
+	v, err := model.Fetch("stale")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := v.(*Timetable)
+	if tasks := stored.List(); len(tasks) != 1 || tasks[0].Id != "y" {
+		t.Fatalf("expected only task y to be scheduled, got %v", tasks)
+	}
+	if leases := stored.Leases(); len(leases) != 1 || leases[0].WorkerId != "w1" {
+		t.Fatal("expected the lease of the first replica to be kept")
+	}
+}
+
+func TestApiV1ReplicasFile(t *testing.T) {
+	model := NewFileModel(t.TempDir())
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	testApiV1Replicas(t, model)
+}
+
+func TestApiV1RefreshUnchanged(t *testing.T) {
+	model := NewFileModel(t.TempDir())
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	api := NewApiV1(model, jrpc2.NewServer("", ""))
+	api.CacheTTL = 0
+	if _, errObj := api.Insert([]byte(`{"key": "k", "id": "a", "runAt": "+1h"}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	schedule := api.timetables["k"].schedule
+	if _, errObj := api.Get([]byte(`{"key": "k"}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if api.timetables["k"].schedule != schedule {
+		t.Fatal("expected an unchanged timetable not to be replaced on refresh")
+	}
+}
+
+func TestApiV1Reschedule(t *testing.T) {
+	model := new(TaskRecordModel)
+	api := NewApiV1(model, jrpc2.NewServer("", ""))
+	if _, errObj := api.Reschedule([]byte(`{"key": "moves", "id": "a", "runAt": "+1h"}`)); errObj == nil {
+		t.Fatal("expected timetable not found error")
+	}
+	if _, errObj := api.Insert([]byte(`{"key": "moves", "id": "a", "runAt": "+1h", "timeZone": "Europe/Berlin"}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if _, errObj := api.Reschedule([]byte(`["moves", "missing", "+1h"]`)); errObj == nil || errObj.Code != TaskNotFoundCode {
+		t.Fatalf("expected task not found error, got %v", errObj)
+	}
+	for _, params := range []string{`["moves", "a", ["+1h"]]`, `["moves", 1, "+1h"]`} {
+		if _, errObj := api.Reschedule([]byte(params)); errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+			t.Fatalf("expected invalid params error for %s, got %v", params, errObj)
+		}
+	}
+	_, errObj := api.Reschedule([]byte(`{"key": "moves", "id": "a", "runAt": "soon"}`))
+	if errObj == nil || errObj.Code != InvalidRunAtCode {
+		t.Fatalf("expected invalid run at error, got %v", errObj)
+	}
+	if data := errObj.Data.(*ErrorData); data.Field != "runAt" || data.Error == "" {
+		t.Fatalf("expected the offending field in the error data, got %+v", data)
+	}
+	model.ops = nil
+	result, errObj := api.Reschedule([]byte(`{"key": "moves", "id": "a", "runAt": "2030-01-01T09:00:00", "payload": {"n": 2}}`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if result != 0 {
+		t.Fatal("expected result to be 0")
+	}
+	if len(model.ops) != 1 || model.ops[0] != "insert moves a" {
+		t.Fatalf("expected the task to be written once, got %v", model.ops)
+	}
+	timetable, _ := api.timetable("moves")
+	tasks := timetable.List()
+	if len(tasks) != 1 || tasks[0].RunAt != "2030-01-01T08:00:00Z" || string(tasks[0].Payload) != `{"n": 2}` {
+		t.Fatalf("expected the task to be rescheduled in its time zone, got %v", tasks[0])
+	}
+
+	// the task is moved back when the save fails.
+	model.err = errors.New("unavailable")
+	if _, errObj := api.Reschedule([]byte(`{"key": "moves", "id": "a", "runAt": "+1m"}`)); errObj == nil {
+		t.Fatal("expected save error")
+	}
+	if tasks := timetable.List(); len(tasks) != 1 || tasks[0].RunAt != "2030-01-01T08:00:00Z" {
+		t.Fatal("expected the task to keep its run at time")
+	}
+
+	// named run at times take the epoch form of insert.
+	model.err = nil
+	if _, errObj := api.Reschedule([]byte(`{"key": "moves", "id": "a", "runAt": 1893488400}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if tasks := timetable.List(); len(tasks) != 1 || tasks[0].RunAt != "2030-01-01T09:00:00Z" {
+		t.Fatalf("expected the task to be rescheduled to the epoch, got %v", tasks[0])
+	}
+	if _, errObj := api.Reschedule([]byte(`{"key": "moves", "id": "a", "runAt": true}`)); errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+		t.Fatalf("expected invalid params error, got %v", errObj)
+	}
+}
+
+func TestApiV1RevisionConflict(t *testing.T) {
+	model := NewMemoryModel()
+	first := NewApiV1(model, jrpc2.NewServer("", ""))
+	if _, errObj := first.Configure([]byte(`{"key": "k", "exclusive": false}`)); errObj != nil {
+		t.Fatal(errObj)
+	}
+	second := NewApiV1(model, jrpc2.NewServer("", ""))
+	if _, errObj := first.Insert([]byte(`{"key": "k", "id": "a", "runAt": "+1h"}`)); errObj != nil {
+		t.Fatal(errObj)
+	}
+	// the second replica saves over a stale revision and retries on the
+	// reloaded timetable.
+	if _, errObj := second.Insert([]byte(`{"key": "k", "id": "b", "runAt": "+2h"}`)); errObj != nil {
+		t.Fatal(errObj)
+	}
+	v, err := model.Fetch("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tasks := v.(*Timetable).List(); len(tasks) != 2 || tasks[0].Id != "a" || tasks[1].Id != "b" {
+		t.Fatal("expected both replicas' tasks to be stored")
+	}
+	if tasks := second.timetables["k"].List(); len(tasks) != 2 {
+		t.Fatal("expected the second replica to reload the timetable")
+	}
+
+	api := NewApiV1(&RecordModel{err: ErrRevisionConflict}, jrpc2.NewServer("", ""))
+	_, errObj := api.Configure([]byte(`{"key": "k", "exclusive": true}`))
+	if errObj == nil || errObj.Code != RevisionConflictCode {
+		t.Fatalf("expected revision conflict error, got %v", errObj)
+	}
+}
+
+func TestApiV1StorageUnavailable(t *testing.T) {
+	api := NewApiV1(&RecordModel{err: errors.New("connection refused")}, jrpc2.NewServer("", ""))
+	_, errObj := api.Configure([]byte(`{"key": "k", "exclusive": true}`))
+	if errObj == nil || errObj.Code != StorageUnavailableCode {
+		t.Fatalf("expected storage unavailable error, got %v", errObj)
+	}
+	if data := errObj.Data.(*ErrorData); data.Error != "connection refused" {
+		t.Fatalf("expected the storage error in the error data, got %+v", data)
+	}
+}
+
+func TestApiV1InsertSaveError(t *testing.T) {
+	model := new(RecordModel)
+	api := NewApiV1(model, jrpc2.NewServer("", ""))
+	model.err = errors.New("connection refused")
+	_, errObj := api.Insert([]byte(`{"key": "k", "id": "a", "runAt": "+0s"}`))
+	if errObj == nil || errObj.Code != StorageUnavailableCode {
+		t.Fatalf("expected storage unavailable error, got %v", errObj)
+	}
+	result, errObj := api.Next([]byte(`{"key": "k"}`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if task, ok := result.(*Task); ok && task != nil {
+		t.Fatalf("expected the unsaved task to be dropped, got %v", task)
+	}
+	model.err = nil
+	if _, errObj := api.Insert([]byte(`{"key": "k", "id": "a", "runAt": "+0s"}`)); errObj != nil {
+		t.Fatalf("expected the retried insert to succeed, got %v", errObj)
+	}
+}
+
+// FetchErrorModel is a model whose reads fail once err is set.
+type FetchErrorModel struct {
+	MockModel
+	err error
+}
+
+func (m *FetchErrorModel) Fetch(key string) (interface{}, error) {
+	return nil, m.err
+}
+
+func TestApiV1FetchError(t *testing.T) {
+	model := new(FetchErrorModel)
+	api := NewApiV1(model, jrpc2.NewServer("", ""))
+	api.CacheTTL = 0
+	if _, errObj := api.Insert([]byte(`{"key": "k", "id": "a", "runAt": "+1h"}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	model.err = errors.New("connection refused")
+	if _, errObj := api.Get([]byte(`{"key": "k"}`)); errObj == nil || errObj.Code != StorageUnavailableCode {
+		t.Fatalf("expected storage unavailable error, got %v", errObj)
+	}
+	_, errObj := api.Insert([]byte(`{"key": "other", "id": "a", "runAt": "+1h"}`))
+	if errObj == nil || errObj.Code != StorageUnavailableCode {
+		t.Fatalf("expected storage unavailable error, got %v", errObj)
+	}
+	if _, ok := api.timetables["other"]; ok {
+		t.Fatal("expected no timetable to be registered when the fetch fails")
+	}
+}
+
+// wait calls Wait in the background and returns once the waiter is
+// blocked on the timetable changes.  The returned channel receives the
+// task handed to the waiter.
+func wait(t *testing.T, api *ApiV1, params string) <-chan *Task {
+	t.Helper()
+	var key struct{ Key string }
+	if err := json.Unmarshal([]byte(params), &key); err != nil {
+		t.Fatal(err)
+	}
+	timetable, errObj := api.timetable(key.Key)
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	// drop the changes channel left behind by earlier waiters.
+	timetable.mu.Lock()
+	timetable.notify()
+	timetable.mu.Unlock()
+
+	tasks := make(chan *Task, 1)
+	go func() {
+		result, errObj := api.Wait([]byte(params))
+		if errObj != nil {
+			t.Error(errObj.Message)
+		}
+		task, _ := result.(*Task)
+		tasks <- task
+	}()
+
+	// the waiter subscribes to the changes before it blocks.
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		timetable.mu.Lock()
+		subscribed := timetable.changes != nil
+		timetable.mu.Unlock()
+		if subscribed {
+			return tasks
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the waiter to block")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestApiV1Wait(t *testing.T) {
+	api := NewApiV1(&MockModel{}, jrpc2.NewServer("", ""))
+	if _, errObj := api.Wait([]byte(`{"key": "w1", "timeoutMs": 10}`)); errObj == nil {
+		t.Fatal("expected timetable not found error")
+	}
+	if _, errObj := api.Insert([]byte(`{"key": "w1", "id": "due", "runAt": "+0s"}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	result, errObj := api.Wait([]byte(`{"key": "w1", "timeoutMs": 5000}`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if task, ok := result.(*Task); !ok || task.Id != "due" {
+		t.Fatalf("expected task due, got %v", result)
+	}
+
+	// nothing is due before the timeout.
+	if _, errObj := api.Insert([]byte(`{"key": "w1", "id": "later", "runAt": "+1h"}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	start := time.Now()
+	result, errObj = api.Wait([]byte(`{"key": "w1", "timeoutMs": 50}`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if result != nil {
+		t.Fatalf("expected nil result, got %v", result)
+	}
+	if elapsed := time.Since(start); elapsed < time.Millisecond*50 {
+		t.Fatalf("expected wait to block for the timeout, returned after %s", elapsed)
+	}
+
+	// an earlier task inserted while waiting is returned once due.
+	waiter := wait(t, api, `{"key": "w1", "timeoutMs": 5000}`)
+	if _, errObj := api.Insert([]byte(`{"key": "w1", "id": "earlier", "runAt": "+30ms"}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if task := <-waiter; task == nil || task.Id != "earlier" {
+		t.Fatalf("expected task earlier, got %v", task)
+	}
+
+	// removing the head wakes the waiter to wait on the new head.
+	if _, errObj := api.Insert([]byte(`{"key": "w1", "id": "head", "runAt": "+30m"}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if _, errObj := api.Remove([]byte(`{"key": "w1", "id": "later"}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if _, errObj := api.Insert([]byte(`{"key": "w1", "id": "soon", "runAt": "+150ms"}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	waiter = wait(t, api, `{"key": "w1", "timeoutMs": 5000}`)
+	if _, errObj := api.Remove([]byte(`{"key": "w1", "id": "head"}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if task := <-waiter; task == nil || task.Id != "soon" {
+		t.Fatalf("expected task soon, got %v", task)
+	}
+	if _, errObj := api.Wait([]byte(`{"key": "w1", "timeoutMs": -1}`)); errObj == nil {
+		t.Fatal("expected invalid params error")
+	}
+	for _, params := range []string{`["w1", "10"]`, `[1, 10]`} {
+		if _, errObj := api.Wait([]byte(params)); errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+			t.Fatalf("expected invalid params error for %s, got %v", params, errObj)
+		}
+	}
+}
+
+func TestApiV1Concurrency(t *testing.T) {
+	api := NewApiV1(&MockModel{}, jrpc2.NewServer("", ""))
+	keys := []string{"c1", "c2", "c3"}
+	now := time.Now()
+	var mu sync.Mutex
+	handed := make(map[string]int)
+	removed := make(map[string]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := keys[i%len(keys)]
+			id := fmt.Sprintf("task%d", i)
+			runAt := now.Add(time.Duration(i-25) * time.Second).Format(time.RFC3339)
+			if _, errObj := api.Insert([]byte(fmt.Sprintf(`{"key": "%s", "id": "%s", "runAt": "%s"}`, key, id, runAt))); errObj != nil {
+				t.Error(errObj.Message)
+				return
+			}
+			api.Delay([]byte(fmt.Sprintf(`{"key": "%s"}`, key)))
+			api.Get([]byte(fmt.Sprintf(`{"key": "%s"}`, key)))
+			api.GetAll([]byte(`{}`))
+			next, _ := api.Next([]byte(fmt.Sprintf(`{"key": "%s"}`, key)))
+			waited, _ := api.Wait([]byte(fmt.Sprintf(`{"key": "%s", "timeoutMs": 1}`, key)))
+			_, errObj := api.Remove([]byte(fmt.Sprintf(`{"key": "%s", "id": "%s"}`, key, id)))
+
+			mu.Lock()
+			defer mu.Unlock()
+			for _, result := range []interface{}{next, waited} {
+				if task, ok := result.(*Task); ok && task != nil {
+					handed[task.Id]++
+				}
+			}
+			removed[id] = errObj == nil
+		}(i)
+	}
+	wg.Wait()
+
+	// every task is handed out, removed or still scheduled exactly once.
+	seen := make(map[string]int)
+	for id, n := range handed {
+		if n > 1 {
+			t.Fatalf("expected task %s to be handed out once, got %d", id, n)
+		}
+		seen[id]++
+	}
+	for id, ok := range removed {
+		if ok {
+			seen[id]++
+		}
+	}
+	for _, key := range keys {
+		if _, errObj := api.Get([]byte(fmt.Sprintf(`{"key": "%s"}`, key))); errObj != nil {
+			t.Fatal(errObj.Message)
+		}
+		timetable := api.timetables[key]
+		timetable.mu.RLock()
+		for _, task := range timetable.List() {
+			seen[task.Id]++
+		}
+		timetable.mu.RUnlock()
+	}
+	if len(seen) != 50 {
+		t.Fatalf("expected 50 tasks to be accounted for, got %d", len(seen))
+	}
+	for i := 0; i < 50; i++ {
+		if id := fmt.Sprintf("task%d", i); seen[id] != 1 {
+			t.Fatalf("expected task %s to be accounted for once, got %d", id, seen[id])
 		}
 	}
 }
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"os"
 	"time"
 
@@ -12,32 +15,72 @@ import (
 
 const (
 	CollectionTimetables = "timetables" // the name of the timetables database collection.
+	CollectionLocks      = "locks"      // the name of the locks database collection.
 )
 
 var db arango.Database // package local arango database instance.
 
+// ErrRevisionConflict is returned when a timetable is saved over a newer
+// revision written by another replica.
+var ErrRevisionConflict = errors.New("timetable revision conflict")
+
 // DocumentMeta contains meta data for an arango document
 type DocumentMeta struct {
 	Id arango.DocumentID
 }
 
 // Model contains methods for interacting with database collections.
+// Fetch returns nil if the document does not exist.  Save returns
+// ErrRevisionConflict if the stored document changed since it was
+// fetched or last saved.
 type Model interface {
 	Create() error
+	Fetch(key string) (interface{}, error)
 	FetchAll() ([]interface{}, error)
 	Save(interface{}) (DocumentMeta, error)
 }
 
+// TaskModel is implemented by models that can persist the state of a
+// single task instead of the whole timetable.  Each write is only applied
+// if the stored revision of the timetable is rev, or if rev is empty and
+// the timetable does not exist, in which case it is created with its
+// default settings.  ErrRevisionConflict is returned otherwise.  Each
+// write returns the new revision of the timetable.
+type TaskModel interface {
+	// InsertTask stores the task as scheduled, replacing any scheduled
+	// or claimed task with the same id.
+	// RemoveTask deletes the scheduled or claimed task with the id.
+	// ClaimTask stores the leased task as claimed, replacing any
+	// scheduled or claimed task with the same id.
+	InsertTask(key string, rev string, task *Task) (string, error)
+	RemoveTask(key string, rev string, id string) (string, error)
+	ClaimTask(key string, rev string, lease *Lease) (string, error)
+}
+
+// LockModel is implemented by models that can store named locks shared
+// by the replicas of the service.
+type LockModel interface {
+	// AcquireLock takes or renews the named lock for the owner until the
+	// ttl passes and reports whether the owner holds the lock.  A lock
+	// held by another owner can only be taken once it expired.
+	// ReleaseLock releases the named lock if the owner holds it.
+	AcquireLock(name string, owner string, ttl time.Duration) (bool, error)
+	ReleaseLock(name string, owner string) error
+}
+
 // TimetableModel represents a priority queue collection model.
 type TimetableModel struct{}
 
-// Create creates the timetables collection in the arangodb database.
+// Create creates the timetables and locks collections in the arangodb
+// database.
 func (model *TimetableModel) Create() error {
-	_, err := db.CreateCollection(nil, CollectionTimetables, nil)
-	if err != nil && arango.IsConflict(err) {
-		return nil
+	for _, name := range []string{CollectionTimetables, CollectionLocks} {
+		_, err := db.CreateCollection(nil, name, nil)
+		if err != nil && !arango.IsConflict(err) {
+			return err
+		}
 	}
-	return err
+	return nil
 }
 
 // FetchAll gets all documents from the timetables collection.
@@ -50,51 +93,228 @@ func (model *TimetableModel) FetchAll() ([]interface{}, error) {
 	}
 	defer cursor.Close()
 	for {
-		t := new(Timetable)
-		_, err := cursor.ReadDocument(nil, t)
+		var data json.RawMessage
+		meta, err := cursor.ReadDocument(nil, &data)
 		if arango.IsNoMoreDocuments(err) {
 			break
 		} else if err != nil {
 			return nil, err
 		}
+		t := new(Timetable)
+		if err := json.Unmarshal(data, t); err != nil {
+			log.Printf("skipping timetable %s: %s", meta.Key, err)
+			continue
+		}
+		t.rev = meta.Rev
 		timetables = append(timetables, t)
 	}
 	return timetables, nil
 }
 
-// Query runs the AQL query against the timetables model collection.
+// Fetch gets the document with the provided key from the timetables
+// collection.
+func (model *TimetableModel) Fetch(key string) (interface{}, error) {
+	col, err := db.Collection(nil, CollectionTimetables)
+	if err != nil {
+		return nil, err
+	}
+	t := new(Timetable)
+	meta, err := col.ReadDocument(nil, key, t)
+	if arango.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	t.rev = meta.Rev
+	return t, nil
+}
+
+// Save writes the timetable to the timetables collection.  Documents
+// are created if the timetable has no revision, otherwise they are only
+// updated if the stored revision matches.
 func (model *TimetableModel) Save(table interface{}) (DocumentMeta, error) {
 	var meta arango.DocumentMeta
 	var doc struct {
-		Key      string  `json:"_key"`
-		Schedule []*Task `json:"schedule"`
+		Key        string      `json:"_key"`
+		Exclusive  bool        `json:"exclusive"`
+		TimeZone   string      `json:"timeZone"`
+		Callback   *Callback   `json:"callback"`
+		Order      string      `json:"order"`
+		Schedule   []*Task     `json:"schedule"`
+		Leases     []*Lease    `json:"leases"`
+		Deliveries []*Delivery `json:"deliveries"`
 	}
 	col, err := db.Collection(nil, CollectionTimetables)
 	if err != nil {
 		return DocumentMeta{}, err
 	}
-	data, err := json.Marshal(table.(*Timetable))
+	timetable := table.(*Timetable)
+	data, err := json.Marshal(timetable)
 	if err != nil {
 		return DocumentMeta{}, err
 	}
 	if err := json.Unmarshal(data, &doc); err != nil {
 		return DocumentMeta{}, err
 	}
-	meta, err = col.CreateDocument(nil, doc)
-	if arango.IsConflict(err) {
+	if timetable.rev == "" {
+		meta, err = col.CreateDocument(nil, doc)
+		if arango.IsConflict(err) {
+			return DocumentMeta{}, ErrRevisionConflict
+		} else if err != nil {
+			return DocumentMeta{}, err
+		}
+	} else {
 		patch := map[string]interface{}{
-			"schedule": doc.Schedule,
+			"exclusive":  doc.Exclusive,
+			"timeZone":   doc.TimeZone,
+			"callback":   doc.Callback,
+			"order":      doc.Order,
+			"schedule":   doc.Schedule,
+			"leases":     doc.Leases,
+			"deliveries": doc.Deliveries,
 		}
-		meta, err = col.UpdateDocument(nil, doc.Key, patch)
-		if err != nil {
+		ctx := arango.WithRevision(context.Background(), timetable.rev)
+		meta, err = col.UpdateDocument(ctx, doc.Key, patch)
+		if arango.IsPreconditionFailed(err) || arango.IsNotFound(err) {
+			return DocumentMeta{}, ErrRevisionConflict
+		} else if err != nil {
 			return DocumentMeta{}, err
 		}
-	} else if err != nil {
-		return DocumentMeta{}, err
 	}
+	timetable.rev = meta.Rev
 	return DocumentMeta{Id: meta.ID}, nil
 }
 
+// InsertTask pushes the task onto the schedule of the timetable document
+// without rewriting the rest of the schedule.
+func (model *TimetableModel) InsertTask(key string, rev string, task *Task) (string, error) {
+	if rev == "" {
+		return model.create(key, []*Task{task}, []*Lease{})
+	}
+	query := fmt.Sprintf(`
+		LET t = DOCUMENT(%s, @key)
+		UPDATE { _key: @key, _rev: @rev } WITH {
+			schedule: PUSH(NOT_NULL(t.schedule, [])[* FILTER CURRENT._key != @id], @task),
+			leases: NOT_NULL(t.leases, [])[* FILTER CURRENT.task._key != @id]
+		}
+		IN %s OPTIONS { ignoreRevs: false }
+		RETURN NEW._rev`, CollectionTimetables, CollectionTimetables)
+	return model.revision(query, map[string]interface{}{"key": key, "rev": rev, "id": task.Id, "task": task})
+}
+
+// RemoveTask removes the task from the schedule and leases of the
+// timetable document.
+func (model *TimetableModel) RemoveTask(key string, rev string, id string) (string, error) {
+	if rev == "" {
+		return model.create(key, []*Task{}, []*Lease{})
+	}
+	query := fmt.Sprintf(`
+		LET t = DOCUMENT(%s, @key)
+		UPDATE { _key: @key, _rev: @rev } WITH {
+			schedule: NOT_NULL(t.schedule, [])[* FILTER CURRENT._key != @id],
+			leases: NOT_NULL(t.leases, [])[* FILTER CURRENT.task._key != @id]
+		}
+		IN %s OPTIONS { ignoreRevs: false }
+		RETURN NEW._rev`, CollectionTimetables, CollectionTimetables)
+	return model.revision(query, map[string]interface{}{"key": key, "rev": rev, "id": id})
+}
+
+// ClaimTask moves the leased task from the schedule to the leases of the
+// timetable document.
+func (model *TimetableModel) ClaimTask(key string, rev string, lease *Lease) (string, error) {
+	if rev == "" {
+		return model.create(key, []*Task{}, []*Lease{lease})
+	}
+	query := fmt.Sprintf(`
+		LET t = DOCUMENT(%s, @key)
+		UPDATE { _key: @key, _rev: @rev } WITH {
+			schedule: NOT_NULL(t.schedule, [])[* FILTER CURRENT._key != @id],
+			leases: PUSH(NOT_NULL(t.leases, [])[* FILTER CURRENT.task._key != @id], @lease)
+		}
+		IN %s OPTIONS { ignoreRevs: false }
+		RETURN NEW._rev`, CollectionTimetables, CollectionTimetables)
+	return model.revision(query, map[string]interface{}{"key": key, "rev": rev, "id": lease.Task.Id, "lease": lease})
+}
+
+// create creates the timetable document with its default settings and
+// the schedule and leases, and returns its revision.
+func (model *TimetableModel) create(key string, schedule []*Task, leases []*Lease) (string, error) {
+	col, err := db.Collection(nil, CollectionTimetables)
+	if err != nil {
+		return "", err
+	}
+	doc := map[string]interface{}{"_key": key, "schedule": schedule, "leases": leases}
+	meta, err := col.CreateDocument(nil, doc)
+	if arango.IsConflict(err) {
+		return "", ErrRevisionConflict
+	} else if err != nil {
+		return "", err
+	}
+	return meta.Rev, nil
+}
+
+// AcquireLock takes or renews the named lock document for the owner.
+func (model *TimetableModel) AcquireLock(name string, owner string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	query := fmt.Sprintf(`
+		UPSERT { _key: @name }
+		INSERT { _key: @name, owner: @owner, expiresAt: @expiresAt }
+		UPDATE OLD.owner == @owner || OLD.expiresAt <= @now ? { owner: @owner, expiresAt: @expiresAt } : {}
+		IN %s
+		RETURN NEW.owner == @owner`, CollectionLocks)
+	cursor, err := db.Query(nil, query, map[string]interface{}{
+		"name":      name,
+		"owner":     owner,
+		"now":       now.UnixNano(),
+		"expiresAt": now.Add(ttl).UnixNano(),
+	})
+	if err != nil {
+		return false, err
+	}
+	defer cursor.Close()
+	var held bool
+	if _, err := cursor.ReadDocument(nil, &held); err != nil {
+		return false, err
+	}
+	return held, nil
+}
+
+// ReleaseLock removes the named lock document if the owner holds it.
+func (model *TimetableModel) ReleaseLock(name string, owner string) error {
+	query := fmt.Sprintf(`
+		FOR l IN %s
+			FILTER l._key == @name && l.owner == @owner
+			REMOVE l IN %s`, CollectionLocks, CollectionLocks)
+	return model.query(query, map[string]interface{}{"name": name, "owner": owner})
+}
+
+// revision runs the AQL write query against the timetables collection
+// and returns the revision of the written document.  ErrRevisionConflict
+// is returned if the document is missing or its revision changed.
+func (model *TimetableModel) revision(query string, bindVars map[string]interface{}) (string, error) {
+	cursor, err := db.Query(nil, query, bindVars)
+	if arango.IsConflict(err) || arango.IsPreconditionFailed(err) || arango.IsNotFound(err) {
+		return "", ErrRevisionConflict
+	} else if err != nil {
+		return "", err
+	}
+	defer cursor.Close()
+	var rev string
+	if _, err := cursor.ReadDocument(nil, &rev); err != nil {
+		return "", err
+	}
+	return rev, nil
+}
+
+// query runs the AQL write query against the timetables collection.
+func (model *TimetableModel) query(query string, bindVars map[string]interface{}) error {
+	cursor, err := db.Query(nil, query, bindVars)
+	if err != nil {
+		return err
+	}
+	return cursor.Close()
+}
+
 // InitDatabase connects to the arangodb and creates the collections from the
 // provided models.
 func InitDatabase() {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"os"
 	"testing"
@@ -55,12 +56,17 @@ func (m MockModel) Create() error {
 	return nil
 }
 
+func (m MockModel) Fetch(key string) (interface{}, error) {
+	return nil, nil
+}
+
 func (m MockModel) FetchAll() ([]interface{}, error) {
 	return make([]interface{}, 0), nil
 }
 
-func (m MockModel) Save(interface{}) (DocumentMeta, error) {
-	return DocumentMeta{}, nil
+func (m MockModel) Save(table interface{}) (DocumentMeta, error) {
+	_, err := json.Marshal(table)
+	return DocumentMeta{}, err
 }
 
 func TestTimetableModelCreate(t *testing.T) {
@@ -78,7 +84,7 @@ func TestTimetableModelSave(t *testing.T) {
 		t.Skip("skipping integration test")
 	}
 	timetable := NewTimetable("this")
-	timetable.Insert(&Task{Id: "123", RunAt: time.Now().String()})
+	timetable.Insert(&Task{Id: "123", RunAt: time.Now().Format(time.RFC3339)})
 	model := new(TimetableModel)
 	if _, err := model.Save(timetable); err != nil {
 		t.Fatal(err)
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	DeliveryRetrying  = "retrying"  // the delivery failed and is scheduled to be retried.
+	DeliveryDelivered = "delivered" // the callback accepted the delivery.
+	DeliveryFailed    = "failed"    // the delivery failed on every attempt.
+)
+
+const (
+	DispatcherWorkerId = "dispatcher" // the worker id of the leases held by the dispatcher.
+	MaxDeliveryHistory = 100          // the number of finished deliveries kept per timetable.
+	RedactedHeader     = "[redacted]" // the callback header value shown to clients.
+)
+
+// Callback is the HTTP request sent when a task comes due.
+type Callback struct {
+	// Url is the absolute http or https url of the callback.
+	// Method is the HTTP method, POST if empty.
+	// Headers are added to the request.
+	// Body is a text/template rendered with the timetable Key and the
+	// Task.  The task is sent as JSON if empty.
+	Url     string            `json:"url"`
+	Method  string            `json:"method,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+}
+
+// redact returns a copy of the callback with each header value replaced
+// by RedactedHeader, since headers often carry credentials.
+func (callback *Callback) redact() *Callback {
+	if callback == nil || len(callback.Headers) == 0 {
+		return callback
+	}
+	clone := *callback
+	clone.Headers = make(map[string]string, len(callback.Headers))
+	for name := range callback.Headers {
+		clone.Headers[name] = RedactedHeader
+	}
+	return &clone
+}
+
+// Validate reports whether the callback url, method and body template
+// are well formed.
+func (callback *Callback) Validate() error {
+	u, err := url.Parse(callback.Url)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid callback url %q", callback.Url)
+	}
+	switch callback.Method {
+	case "", http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+	default:
+		return fmt.Errorf("invalid callback method %q", callback.Method)
+	}
+	_, err = template.New("body").Parse(callback.Body)
+	return err
+}
+
+// Request builds the callback request for the task in the timetable with
+// the provided key.
+func (callback *Callback) Request(key string, task *Task) (*http.Request, error) {
+	var body bytes.Buffer
+	if callback.Body == "" {
+		data, err := json.Marshal(map[string]interface{}{"key": key, "task": task})
+		if err != nil {
+			return nil, err
+		}
+		body.Write(data)
+	} else {
+		tmpl, err := template.New("body").Parse(callback.Body)
+		if err != nil {
+			return nil, err
+		}
+		if err := tmpl.Execute(&body, map[string]interface{}{"Key": key, "Task": task}); err != nil {
+			return nil, err
+		}
+	}
+	method := callback.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	req, err := http.NewRequest(method, callback.Url, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range callback.Headers {
+		req.Header.Set(name, value)
+	}
+	return req, nil
+}
+
+// Delivery is the outcome of sending the callback of a task.
+type Delivery struct {
+	// TaskId is the id of the delivered task.
+	// Status is one of retrying, delivered or failed.
+	// Attempts is the number of requests sent for the occurrence.
+	// StatusCode is the HTTP status of the last response.
+	// Error describes why the last attempt failed.
+	// AttemptedAt is the point in time of the last attempt.
+	// RetryAt is the run at time of the next attempt.
+	TaskId      string    `json:"taskId"`
+	Status      string    `json:"status"`
+	Attempts    int       `json:"attempts"`
+	StatusCode  int       `json:"statusCode,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	AttemptedAt time.Time `json:"attemptedAt"`
+	RetryAt     string    `json:"retryAt,omitempty"`
+}
+
+// Dispatcher sends the callbacks of due tasks.  Tasks are leased while
+// their callbacks are in flight, failed deliveries are retried with
+// exponential backoff and the outcome is recorded on the task and in
+// the timetable delivery history.  When several replicas run, only the
+// elected leader checks for due tasks.
+type Dispatcher struct {
+	// Interval is the time between checks for due tasks.
+	// MaxAttempts is the number of attempts before a delivery fails.
+	// Backoff is the delay before the first retry, doubled on each
+	// further retry up to MaxBackoff.
+	// Timeout bounds each callback request and the lease held on it.
+	// Elector elects the replica that checks for due tasks.
+	// Id identifies the dispatcher in elections.
+	// LeaderTTL is the time leadership is held without renewal, it
+	// must be longer than the interval.
+	Interval    time.Duration
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+	Timeout     time.Duration
+	Elector     Elector
+	Id          string
+	LeaderTTL   time.Duration
+	api         *ApiV1
+	client      *http.Client
+	leading     bool
+	stop        chan struct{}
+	wg          sync.WaitGroup
+}
+
+// Start checks for due tasks in the background until Stop is called.
+func (d *Dispatcher) Start() {
+	d.stop = make(chan struct{})
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		ticker := time.NewTicker(d.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-d.stop:
+				return
+			case <-ticker.C:
+				if d.lead() {
+					d.Dispatch()
+				}
+			}
+		}
+	}()
+}
+
+// Stop stops checking for due tasks, waits for the deliveries in flight
+// and hands the leadership over to another replica.
+func (d *Dispatcher) Stop() {
+	close(d.stop)
+	d.wg.Wait()
+	if err := d.Elector.Resign(d.Id); err != nil {
+		log.Println(err)
+	}
+}
+
+// lead acquires or renews the leadership of the dispatcher and reports
+// whether it is the leader.  The dispatcher steps down if the election
+// fails.
+func (d *Dispatcher) lead() bool {
+	leader, err := d.Elector.Elect(d.Id, d.LeaderTTL)
+	if err != nil {
+		log.Println(err)
+		leader = false
+	}
+	if leader != d.leading {
+		if leader {
+			log.Printf("dispatcher %s is the leader", d.Id)
+		} else {
+			log.Printf("dispatcher %s is no longer the leader", d.Id)
+		}
+		d.leading = leader
+	}
+	return leader
+}
+
+// Dispatch leases the due tasks with callbacks in every timetable and
+// delivers them in the background.
+func (d *Dispatcher) Dispatch() {
+	for _, timetable := range d.api.list() {
+		timetable.mu.Lock()
+		leases, prevs, err := timetable.dispatch(DispatcherWorkerId, d.Timeout*2)
+		if err == nil && len(leases) > 0 {
+			ids := make([]string, len(leases))
+			for i, lease := range leases {
+				ids[i] = lease.Task.Id
+			}
+			err = timetable.SaveTasks(d.api.model, ids...)
+		}
+		if err != nil {
+			// leases that are not stored are undone and their tasks are
+			// leased again on the next check.
+			for i, lease := range leases {
+				timetable.unclaim(lease, prevs[i])
+			}
+			leases = nil
+		}
+		if errors.Is(err, ErrRevisionConflict) {
+			// another replica changed the timetable.
+			if err = d.api.reload(timetable); err == nil {
+				timetable.mu.Unlock()
+				continue
+			}
+		}
+		timetable.mu.Unlock()
+		if err != nil {
+			log.Println(err)
+		}
+		for _, lease := range leases {
+			d.wg.Add(1)
+			go func(timetable *Timetable, lease *Lease) {
+				defer d.wg.Done()
+				d.deliver(timetable, lease)
+			}(timetable, lease)
+		}
+	}
+}
+
+// deliver sends the callback of the leased task and records the
+// outcome.  Delivered and failed tasks are acked, the others are
+// returned to the schedule at their retry time.
+func (d *Dispatcher) deliver(timetable *Timetable, lease *Lease) {
+	timetable.mu.RLock()
+	callback := timetable.callback(lease.Task)
+	task := *lease.Task
+	timetable.mu.RUnlock()
+
+	delivery := &Delivery{TaskId: task.Id, Attempts: 1}
+	if prev := task.Delivery; prev != nil && prev.Status == DeliveryRetrying {
+		delivery.Attempts = prev.Attempts + 1
+	}
+	delivery.AttemptedAt = time.Now()
+	if err := d.send(callback, timetable.Key, &task, delivery); err == nil {
+		delivery.Status = DeliveryDelivered
+	} else if delivery.Attempts < d.MaxAttempts {
+		delivery.Status = DeliveryRetrying
+		delivery.Error = err.Error()
+		delivery.RetryAt = FormatRunAt(time.Now().Add(d.backoff(delivery.Attempts)))
+	} else {
+		delivery.Status = DeliveryFailed
+		delivery.Error = err.Error()
+	}
+
+	timetable.mu.Lock()
+	defer timetable.mu.Unlock()
+	for i := 0; ; i++ {
+		current, ok := timetable.leases[lease.Task.Id]
+		if !ok || current.Token != lease.Token {
+			// the lease expired and was handed out again.
+			return
+		}
+		current.Task.Delivery = delivery
+		var err error
+		if delivery.Status == DeliveryRetrying {
+			_, err = timetable.Nack(lease.Task.Id, lease.Token, delivery.RetryAt)
+		} else {
+			timetable.Record(delivery)
+			_, err = timetable.Ack(lease.Task.Id, lease.Token)
+		}
+		if err == nil {
+			_, err = timetable.Save(d.api.model)
+		}
+		if errors.Is(err, ErrRevisionConflict) && i < MaxConflictRetries {
+			// record the outcome on the stored version of the lease.
+			if err = d.api.reload(timetable); err == nil {
+				continue
+			}
+		}
+		if err != nil {
+			log.Println(err)
+		}
+		return
+	}
+}
+
+// send sends the callback request and fails unless the response has a
+// 2xx status.
+func (d *Dispatcher) send(callback *Callback, key string, task *Task, delivery *Delivery) error {
+	if callback == nil {
+		return errors.New("task has no callback")
+	}
+	req, err := callback.Request(key, task)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d.Timeout)
+	defer cancel()
+	res, err := d.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	delivery.StatusCode = res.StatusCode
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("callback responded %s", res.Status)
+	}
+	return nil
+}
+
+// backoff returns the delay before the retry following the attempt.
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.Backoff
+	for i := 1; i < attempts && delay < d.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > d.MaxBackoff {
+		delay = d.MaxBackoff
+	}
+	return delay
+}
+
+// NewDispatcher creates a dispatcher for the timetables of the api.
+func NewDispatcher(api *ApiV1) *Dispatcher {
+	return &Dispatcher{
+		Interval:    time.Second,
+		MaxAttempts: 5,
+		Backoff:     time.Second,
+		MaxBackoff:  time.Minute * 5,
+		Timeout:     time.Second * 10,
+		Elector:     NewElector(api.model),
+		Id:          newCandidateId(),
+		LeaderTTL:   DefaultLeaderTTL,
+		api:         api,
+		client:      &http.Client{},
+	}
+}
+
+// DispatcherEnabled reports whether the DISPATCHER_ENABLED environment
+// variable turns the dispatcher on.
+func DispatcherEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv("DISPATCHER_ENABLED"))
+	return enabled
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bitwurx/jrpc2"
+)
+
+// newTestDispatcher returns a dispatcher with short intervals for the
+// api.
+func newTestDispatcher(api *ApiV1) *Dispatcher {
+	d := NewDispatcher(api)
+	d.Interval = time.Millisecond * 5
+	d.Backoff = time.Millisecond * 10
+	d.MaxBackoff = time.Millisecond * 40
+	d.Timeout = time.Second
+	return d
+}
+
+// waitDeliveries waits for the timetable to record n finished deliveries.
+func waitDeliveries(t *testing.T, timetable *Timetable, n int) []*Delivery {
+	deadline := time.Now().Add(time.Second * 5)
+	for time.Now().Before(deadline) {
+		timetable.mu.RLock()
+		deliveries := timetable.Deliveries()
+		timetable.mu.RUnlock()
+		if len(deliveries) >= n {
+			return deliveries
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+	t.Fatalf("expected %d deliveries", n)
+	return nil
+}
+
+func TestCallbackValidate(t *testing.T) {
+	valid := []*Callback{
+		{Url: "http://example.com/hook"},
+		{Url: "https://example.com/hook", Method: "PUT", Body: `{"id": "{{.Task.Id}}"}`},
+	}
+	for _, callback := range valid {
+		if err := callback.Validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	invalid := []*Callback{
+		{Url: ""},
+		{Url: "ftp://example.com"},
+		{Url: "http://example.com", Method: "TRACE"},
+		{Url: "http://example.com", Body: "{{.Task"},
+	}
+	for _, callback := range invalid {
+		if err := callback.Validate(); err == nil {
+			t.Fatalf("expected %v to be invalid", callback)
+		}
+	}
+}
+
+func TestDispatcherDeliver(t *testing.T) {
+	var mu sync.Mutex
+	var method, header, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		method, header, body = r.Method, r.Header.Get("X-Token"), string(data)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	api := NewApiV1(&MockModel{}, jrpc2.NewServer("", ""))
+	callback, _ := json.Marshal(&Callback{
+		Url:     server.URL,
+		Method:  "PUT",
+		Headers: map[string]string{"X-Token": "secret"},
+		Body:    `{"key": "{{.Key}}", "id": "{{.Task.Id}}"}`,
+	})
+	if _, errObj := api.Insert([]byte(`{"key": "hooks", "id": "later", "runAt": "+1h", "callback": ` + string(callback) + `}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if _, errObj := api.Insert([]byte(`{"key": "hooks", "id": "now", "runAt": "+0s", "callback": ` + string(callback) + `}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	d := newTestDispatcher(api)
+	d.Start()
+	defer d.Stop()
+
+	timetable, _ := api.timetable("hooks")
+	deliveries := waitDeliveries(t, timetable, 1)
+	if deliveries[0].TaskId != "now" || deliveries[0].Status != DeliveryDelivered || deliveries[0].Attempts != 1 {
+		t.Fatalf("expected task now to be delivered, got %v", deliveries[0])
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if method != "PUT" || header != "secret" || body != `{"key": "hooks", "id": "now"}` {
+		t.Fatalf("unexpected request %s %s %s", method, header, body)
+	}
+	timetable.mu.RLock()
+	defer timetable.mu.RUnlock()
+	if tasks := timetable.List(); len(tasks) != 1 || tasks[0].Id != "later" {
+		t.Fatal("expected only task later to be scheduled")
+	}
+	if len(timetable.Leases()) != 0 {
+		t.Fatal("expected no leases")
+	}
+}
+
+func TestDispatcherLeader(t *testing.T) {
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		requests[string(data)]++
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	model := NewMemoryModel()
+	replicas := make([]*Dispatcher, 2)
+	for i := range replicas {
+		api := NewApiV1(model, jrpc2.NewServer("", ""))
+		api.CacheTTL = 0
+		replicas[i] = newTestDispatcher(api)
+		replicas[i].LeaderTTL = time.Millisecond * 50
+	}
+	api := replicas[0].api
+	if _, errObj := api.Configure([]byte(`{"key": "leader", "callback": {"url": "` + server.URL + `", "body": "{{.Task.Id}}"}}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if _, errObj := api.Insert([]byte(`{"key": "leader", "id": "first", "runAt": "+0s"}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if leader, _ := replicas[0].Elector.Elect(replicas[0].Id, replicas[0].LeaderTTL); !leader {
+		t.Fatal("expected the first replica to be elected")
+	}
+	for _, d := range replicas {
+		d.Start()
+	}
+	delivered := func(id string) bool {
+		deadline := time.Now().Add(time.Second * 5)
+		for time.Now().Before(deadline) {
+			mu.Lock()
+			n := requests[id]
+			mu.Unlock()
+			if n > 0 {
+				return true
+			}
+			time.Sleep(time.Millisecond * 5)
+		}
+		return false
+	}
+	if !delivered("first") {
+		t.Fatal("expected the leader to deliver the task")
+	}
+
+	// the second replica takes over once the leader stops.
+	replicas[0].Stop()
+	defer replicas[1].Stop()
+	if _, errObj := api.Insert([]byte(`{"key": "leader", "id": "second", "runAt": "+0s"}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if !delivered("second") {
+		t.Fatal("expected the new leader to deliver the task")
+	}
+	time.Sleep(time.Millisecond * 50)
+	mu.Lock()
+	defer mu.Unlock()
+	if requests["first"] != 1 || requests["second"] != 1 {
+		t.Fatalf("expected each task to be delivered once, got %v", requests)
+	}
+}
+
+func TestDispatcherSaveError(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+	}))
+	defer server.Close()
+
+	model := new(RecordModel)
+	api := NewApiV1(model, jrpc2.NewServer("", ""))
+	if _, errObj := api.Insert([]byte(`{"key": "hooks", "id": "now", "runAt": "+0s", "callback": {"url": "` + server.URL + `"}}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	model.err = errors.New("connection refused")
+	time.Sleep(time.Millisecond * 2)
+	d := newTestDispatcher(api)
+	d.Dispatch()
+	d.wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 0 {
+		t.Fatal("expected no delivery of an unsaved lease")
+	}
+	timetable, _ := api.timetable("hooks")
+	timetable.mu.RLock()
+	defer timetable.mu.RUnlock()
+	if len(timetable.Leases()) != 0 || len(timetable.List()) != 1 {
+		t.Fatal("expected the task to be returned to the schedule")
+	}
+}
+
+func TestDispatcherRetry(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if requests++; requests < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	api := NewApiV1(&MockModel{}, jrpc2.NewServer("", ""))
+	if _, errObj := api.Configure([]byte(`{"key": "retry", "callback": {"url": "` + server.URL + `"}}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if _, errObj := api.Insert([]byte(`{"key": "retry", "id": "abc123", "runAt": "+0s"}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	d := newTestDispatcher(api)
+	d.Start()
+	defer d.Stop()
+
+	timetable, _ := api.timetable("retry")
+	deliveries := waitDeliveries(t, timetable, 1)
+	if deliveries[0].Status != DeliveryDelivered || deliveries[0].Attempts != 3 || deliveries[0].StatusCode != 200 {
+		t.Fatalf("expected delivery on the third attempt, got %v", deliveries[0])
+	}
+}
+
+func TestDispatcherFailed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	api := NewApiV1(&MockModel{}, jrpc2.NewServer("", ""))
+	if _, errObj := api.Insert([]byte(`{"key": "failed", "id": "abc123", "runAt": "+0s", "cron": "0 0 * * *", "callback": {"url": "` + server.URL + `"}}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	d := newTestDispatcher(api)
+	d.MaxAttempts = 2
+	d.Start()
+	defer d.Stop()
+
+	timetable, _ := api.timetable("failed")
+	deliveries := waitDeliveries(t, timetable, 1)
+	if deliveries[0].Status != DeliveryFailed || deliveries[0].Attempts != 2 || deliveries[0].StatusCode != 500 {
+		t.Fatalf("expected delivery to fail after 2 attempts, got %v", deliveries[0])
+	}
+	timetable.mu.RLock()
+	defer timetable.mu.RUnlock()
+	tasks := timetable.List()
+	if len(tasks) != 1 || tasks[0].Delivery == nil || tasks[0].Delivery.Status != DeliveryFailed {
+		t.Fatal("expected the next occurrence to carry the failed delivery")
+	}
+}
+
+func TestDispatcherBackoff(t *testing.T) {
+	d := NewDispatcher(NewApiV1(&MockModel{}, jrpc2.NewServer("", "")))
+	d.Backoff, d.MaxBackoff = time.Second, time.Second*5
+	for attempts, want := range map[int]time.Duration{1: time.Second, 2: time.Second * 2, 3: time.Second * 4, 4: time.Second * 5, 10: time.Second * 5} {
+		if got := d.backoff(attempts); got != want {
+			t.Fatalf("attempt %d: expected backoff %s, got %s", attempts, want, got)
+		}
+	}
+}
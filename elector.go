@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	LeaderLockName   = "leader"         // the name of the lock held by the leader replica.
+	DefaultLeaderTTL = time.Second * 10 // the default time leadership is held without renewal.
+)
+
+// Elector chooses the single replica that runs the background work.
+// Leadership is held for a ttl and must be renewed by electing the same
+// candidate again before it lapses.  Another candidate is elected once
+// the leadership lapses or is resigned.
+type Elector interface {
+	// Elect acquires or renews the leadership for the candidate and
+	// reports whether the candidate is the leader.
+	// Resign gives up the leadership if the candidate holds it.
+	Elect(candidate string, ttl time.Duration) (bool, error)
+	Resign(candidate string) error
+}
+
+// LocalElector elects leaders among the candidates of a single process.
+type LocalElector struct {
+	// leader is the candidate holding the leadership.
+	// expiresAt is the point in time the leadership lapses.
+	// mu guards the leadership.
+	leader    string
+	expiresAt time.Time
+	mu        sync.Mutex
+}
+
+// Elect acquires or renews the leadership for the candidate.
+func (elector *LocalElector) Elect(candidate string, ttl time.Duration) (bool, error) {
+	elector.mu.Lock()
+	defer elector.mu.Unlock()
+	now := time.Now()
+	if elector.leader != candidate && now.Before(elector.expiresAt) {
+		return false, nil
+	}
+	elector.leader = candidate
+	elector.expiresAt = now.Add(ttl)
+	return true, nil
+}
+
+// Resign gives up the leadership held by the candidate.
+func (elector *LocalElector) Resign(candidate string) error {
+	elector.mu.Lock()
+	defer elector.mu.Unlock()
+	if elector.leader == candidate {
+		elector.leader = ""
+		elector.expiresAt = time.Time{}
+	}
+	return nil
+}
+
+// ModelElector elects leaders through a lock document shared by the
+// replicas of the lock model.
+type ModelElector struct {
+	// Name is the name of the lock document.
+	// model stores the lock document.
+	Name  string
+	model LockModel
+}
+
+// Elect acquires or renews the lock for the candidate.
+func (elector *ModelElector) Elect(candidate string, ttl time.Duration) (bool, error) {
+	return elector.model.AcquireLock(elector.Name, candidate, ttl)
+}
+
+// Resign releases the lock if the candidate holds it.
+func (elector *ModelElector) Resign(candidate string) error {
+	return elector.model.ReleaseLock(elector.Name, candidate)
+}
+
+// NewElector returns the elector of the model.  Models that cannot store
+// locks are not shared by replicas, so their leaders are elected in
+// process.
+func NewElector(model Model) Elector {
+	if locks, ok := model.(LockModel); ok {
+		return &ModelElector{Name: LeaderLockName, model: locks}
+	}
+	return new(LocalElector)
+}
+
+// newCandidateId returns an id identifying this replica in elections.
+func newCandidateId() string {
+	host, _ := os.Hostname()
+	token, err := newLeaseToken()
+	if err != nil {
+		token = fmt.Sprint(time.Now().UnixNano())
+	}
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), token[:8])
+}
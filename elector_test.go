@@ -0,0 +1,105 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testElectorConformance runs the behavior every Elector implementation
+// must share.
+func testElectorConformance(t *testing.T, elector Elector) {
+	elect := func(candidate string, ttl time.Duration, want bool) {
+		t.Helper()
+		leader, err := elector.Elect(candidate, ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if leader != want {
+			t.Fatalf("expected %s leader to be %v", candidate, want)
+		}
+	}
+
+	elect("a", time.Minute, true)
+	elect("b", time.Minute, false)
+	elect("a", time.Minute, true)
+
+	// resigning hands the leadership over at once.
+	if err := elector.Resign("b"); err != nil {
+		t.Fatal(err)
+	}
+	elect("b", time.Minute, false)
+	if err := elector.Resign("a"); err != nil {
+		t.Fatal(err)
+	}
+	elect("b", time.Millisecond*50, true)
+	elect("a", time.Minute, false)
+
+	// a lapsed leadership goes to the next candidate.
+	time.Sleep(time.Millisecond * 60)
+	elect("a", time.Minute, true)
+	elect("b", time.Minute, false)
+	if err := elector.Resign("a"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLocalElector(t *testing.T) {
+	testElectorConformance(t, new(LocalElector))
+}
+
+func TestModelElectorMemory(t *testing.T) {
+	testElectorConformance(t, NewElector(NewMemoryModel()))
+}
+
+func TestModelElectorSQL(t *testing.T) {
+	model := newTestSQLModel(t, filepath.Join(t.TempDir(), "timetables.db"))
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	testElectorConformance(t, NewElector(model))
+}
+
+func TestModelElectorFile(t *testing.T) {
+	dir := t.TempDir()
+	model := NewFileModel(dir)
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	testElectorConformance(t, NewElector(model))
+
+	// replicas sharing the directory elect a single leader.
+	a, b := NewElector(model), NewElector(NewFileModel(dir))
+	if leader, err := a.Elect("a", time.Minute); err != nil || !leader {
+		t.Fatalf("expected a to be elected, got %v %v", leader, err)
+	}
+	if leader, err := b.Elect("b", time.Minute); err != nil || leader {
+		t.Fatalf("expected b not to be elected, got %v %v", leader, err)
+	}
+	if timetables, err := model.FetchAll(); err != nil || len(timetables) != 0 {
+		t.Fatalf("expected the lock not to be listed as a timetable, got %v %v", timetables, err)
+	}
+}
+
+func TestModelElectorArangoDB(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+	model := new(TimetableModel)
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	testElectorConformance(t, NewElector(model))
+}
+
+func TestNewElector(t *testing.T) {
+	if _, ok := NewElector(NewMemoryModel()).(*ModelElector); !ok {
+		t.Fatal("expected a model elector for a lock model")
+	}
+	if _, ok := NewElector(NewFileModel(t.TempDir())).(*ModelElector); !ok {
+		t.Fatal("expected a model elector for the file model")
+	}
+	if _, ok := NewElector(MockModel{}).(*LocalElector); !ok {
+		t.Fatal("expected a local elector for a model without locks")
+	}
+}
@@ -1,12 +1,33 @@
 package main
 
 import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+
 	"github.com/bitwurx/jrpc2"
 )
 
 func main() {
-	InitDatabase()
+	model, err := NewModel(os.Getenv("TIMETABLE_STORAGE"), os.Getenv("TIMETABLE_STORAGE_PATH"))
+	if err != nil {
+		log.Fatal(err)
+	}
 	s := jrpc2.NewServer(":8080", "/rpc")
-	NewApiV1(&TimetableModel{}, s)
+	api := NewApiV1(model, s)
+	if v := os.Getenv("MAX_PAYLOAD_SIZE"); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil || size <= 0 {
+			log.Fatalf("MAX_PAYLOAD_SIZE must be a positive number of bytes, got %q", v)
+		}
+		api.MaxPayloadSize = size
+	}
+	if ttl, err := strconv.Atoi(os.Getenv("CACHE_TTL_MS")); err == nil {
+		api.CacheTTL = time.Duration(ttl) * time.Millisecond
+	}
+	if DispatcherEnabled() {
+		NewDispatcher(api).Start()
+	}
 	s.Start()
 }
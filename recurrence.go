@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/teambition/rrule-go"
+)
+
+// cronParser parses standard 5 field cron expressions, 6 field
+// expressions with a leading seconds field and descriptors such as
+// @hourly and @daily.
+var cronParser = cron.NewParser(
+	cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor,
+)
+
+// Recurrence computes the occurrences of a recurring task.
+type Recurrence interface {
+	// Next returns the first occurrence after the provided time, or the
+	// zero time if there are no more occurrences.
+	Next(time.Time) time.Time
+}
+
+// ParseCron parses the cron expression evaluated on the wall clock of
+// the named time zone.  UTC is used if the time zone is empty.
+func ParseCron(expr string, timeZone string) (Recurrence, error) {
+	loc, err := LoadLocation(timeZone)
+	if err != nil {
+		return nil, err
+	}
+	schedule, err := cronParser.Parse("CRON_TZ=UTC " + expr)
+	if err != nil {
+		return nil, err
+	}
+	return &zonedRecurrence{schedule, loc}, nil
+}
+
+// rruleRecurrence is the recurrence of an iCalendar RRULE.
+type rruleRecurrence struct {
+	rule *rrule.RRule
+}
+
+// Next returns the first occurrence of the rule after the provided time.
+func (r *rruleRecurrence) Next(t time.Time) time.Time {
+	return r.rule.After(t, false)
+}
+
+// ParseRRule parses the RFC 5545 recurrence rule evaluated on the wall
+// clock of the named time zone.  The rule may carry its own DTSTART
+// line, otherwise the series starts at the provided point in time.  UTC
+// is used if the time zone is empty.
+func ParseRRule(rule string, start time.Time, timeZone string) (Recurrence, error) {
+	loc, err := LoadLocation(timeZone)
+	if err != nil {
+		return nil, err
+	}
+	option, err := rrule.StrToROptionInLocation(rule, loc)
+	if err != nil {
+		return nil, err
+	}
+	if option.Dtstart.IsZero() {
+		option.Dtstart = start
+	}
+	option.Dtstart = WallClock(option.Dtstart, loc)
+	if !option.Until.IsZero() {
+		option.Until = WallClock(option.Until, loc)
+	}
+	r, err := rrule.NewRRule(*option)
+	if err != nil {
+		return nil, err
+	}
+	return &zonedRecurrence{&rruleRecurrence{r}, loc}, nil
+}
+
+// Recurrence returns the recurrence of the task, or nil if the task
+// runs only once.
+func (task *Task) Recurrence() (Recurrence, error) {
+	switch {
+	case task.Cron != "" && task.RRule != "":
+		return nil, errors.New("task cron and rrule are exclusive")
+	case task.Cron != "":
+		return ParseCron(task.Cron, task.TimeZone)
+	case task.RRule != "":
+		start, err := time.Parse(time.RFC3339, task.Start)
+		if err != nil && task.Start != "" {
+			return nil, err
+		}
+		return ParseRRule(task.RRule, start, task.TimeZone)
+	}
+	return nil, nil
+}
+
+// Preview returns the run at times of the next n occurrences of the
+// task starting with its current run at time.
+func (task *Task) Preview(n int) ([]string, error) {
+	occurrences := make([]string, 0, n)
+	if n < 1 {
+		return occurrences, nil
+	}
+	at, err := time.Parse(time.RFC3339, task.RunAt)
+	if err != nil {
+		return nil, err
+	}
+	occurrences = append(occurrences, task.RunAt)
+	recurrence, err := task.Recurrence()
+	if err != nil || recurrence == nil {
+		return occurrences, err
+	}
+	for len(occurrences) < n {
+		if at = recurrence.Next(at); at.IsZero() {
+			break
+		}
+		occurrences = append(occurrences, FormatRunAt(at))
+	}
+	return occurrences, nil
+}
+
+// Schedule sets the run at time of the task from the run at value
+// relative to now.  A recurring task without a run at value is scheduled
+// at its first occurrence.  The run at value of a task with a recurrence
+// rule starts the rule series, and the task is scheduled at the first
+// occurrence of the series at or after it.
+func (task *Task) Schedule(runAt string, now time.Time) error {
+	var at time.Time
+	if runAt != "" {
+		var err error
+		if at, err = ParseRunAt(runAt, now); err != nil {
+			return err
+		}
+	}
+	if task.RRule != "" {
+		// recurrence rules have second precision.
+		start := at.Truncate(time.Second)
+		if start.IsZero() {
+			start = now.Truncate(time.Second)
+		}
+		task.Start = FormatRunAt(start)
+		at = time.Time{}
+		now = start.Add(-time.Nanosecond)
+	}
+	recurrence, err := task.Recurrence()
+	if err != nil {
+		return err
+	}
+	if at.IsZero() {
+		if recurrence == nil {
+			return errors.New("task runAt is required")
+		}
+		if at = recurrence.Next(now); at.IsZero() {
+			return errors.New("task recurrence has no occurrences")
+		}
+	}
+	task.RunAt = FormatRunAt(at)
+	return nil
+}
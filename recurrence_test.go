@@ -0,0 +1,136 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	from := time.Date(2018, 3, 1, 12, 7, 30, 0, time.UTC)
+	tests := []struct {
+		expr     string
+		timeZone string
+		want     time.Time
+	}{
+		{"*/15 * * * *", "", time.Date(2018, 3, 1, 12, 15, 0, 0, time.UTC)},
+		{"30 */15 * * * *", "", time.Date(2018, 3, 1, 12, 15, 30, 0, time.UTC)},
+		{"@hourly", "", time.Date(2018, 3, 1, 13, 0, 0, 0, time.UTC)},
+		{"@daily", "", time.Date(2018, 3, 2, 0, 0, 0, 0, time.UTC)},
+		{"0 9 * * *", "America/New_York", time.Date(2018, 3, 1, 14, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		recurrence, err := ParseCron(test.expr, test.timeZone)
+		if err != nil {
+			t.Fatalf("%q: %s", test.expr, err)
+		}
+		if got := recurrence.Next(from); !got.Equal(test.want) {
+			t.Fatalf("%q: expected %s, got %s", test.expr, test.want, got)
+		}
+	}
+	if _, err := ParseCron("* * *", ""); err == nil {
+		t.Fatal("expected cron parse error")
+	}
+	if _, err := ParseCron("@daily", "Nowhere/Special"); err == nil {
+		t.Fatal("expected time zone error")
+	}
+}
+
+func TestTaskRecurrence(t *testing.T) {
+	if recurrence, err := (&Task{}).Recurrence(); err != nil || recurrence != nil {
+		t.Fatal("expected task without cron not to recur")
+	}
+	if recurrence, err := (&Task{Cron: "@hourly"}).Recurrence(); err != nil || recurrence == nil {
+		t.Fatal("expected task with cron to recur")
+	}
+}
+
+func TestParseRRule(t *testing.T) {
+	start := time.Date(2018, 3, 1, 9, 0, 0, 0, time.UTC)
+	recurrence, err := ParseRRule("FREQ=MINUTELY;INTERVAL=90", start, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := recurrence.Next(start); !got.Equal(start.Add(time.Minute * 90)) {
+		t.Fatalf("expected occurrence 90 minutes after start, got %s", got)
+	}
+
+	recurrence, err = ParseRRule("FREQ=WEEKLY;INTERVAL=2;BYDAY=TU;COUNT=2", start, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := recurrence.Next(start)
+	if first.Weekday() != time.Tuesday || !first.Equal(time.Date(2018, 3, 13, 9, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected first occurrence on tuesday the 13th, got %s", first)
+	}
+	second := recurrence.Next(first)
+	if !second.Equal(time.Date(2018, 3, 27, 9, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected second occurrence two weeks later, got %s", second)
+	}
+	if !recurrence.Next(second).IsZero() {
+		t.Fatal("expected the series to end after the count")
+	}
+
+	recurrence, err = ParseRRule("DTSTART:20180301T090000Z\nRRULE:FREQ=DAILY;UNTIL=20180303T090000Z", time.Time{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := recurrence.Next(start.Add(time.Hour * 24)); !got.Equal(start.Add(time.Hour * 48)) {
+		t.Fatalf("expected last occurrence on the until date, got %s", got)
+	}
+	if !recurrence.Next(start.Add(time.Hour * 48)).IsZero() {
+		t.Fatal("expected the series to end on the until date")
+	}
+
+	if _, err := ParseRRule("INTERVAL=2", start, ""); err == nil {
+		t.Fatal("expected rrule parse error")
+	}
+	if _, err := (&Task{Cron: "@daily", RRule: "FREQ=DAILY"}).Recurrence(); err == nil {
+		t.Fatal("expected cron and rrule to be exclusive")
+	}
+}
+
+func TestTaskSchedule(t *testing.T) {
+	now := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	task := &Task{RRule: "FREQ=WEEKLY;BYDAY=TU;BYHOUR=9;BYMINUTE=0;BYSECOND=0"}
+	if err := task.Schedule("", now); err != nil {
+		t.Fatal(err)
+	}
+	if task.RunAt != "2018-03-06T09:00:00Z" || task.Start != "2018-03-01T12:00:00Z" {
+		t.Fatalf("got unexpected first occurrence %s", task.RunAt)
+	}
+	task = &Task{RRule: "FREQ=HOURLY;COUNT=3"}
+	if err := task.Schedule("2018-03-01T13:00:00Z", now); err != nil {
+		t.Fatal(err)
+	}
+	if task.RunAt != "2018-03-01T13:00:00Z" {
+		t.Fatalf("expected run at to start the series, got %s", task.RunAt)
+	}
+	task = &Task{}
+	if err := task.Schedule("", now); err == nil {
+		t.Fatal("expected run at required error")
+	}
+}
+
+func TestTaskPreview(t *testing.T) {
+	task := &Task{RRule: "FREQ=HOURLY;COUNT=3"}
+	if err := task.Schedule("2018-03-01T13:00:00Z", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	occurrences, err := task.Preview(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"2018-03-01T13:00:00Z", "2018-03-01T14:00:00Z", "2018-03-01T15:00:00Z"}
+	if len(occurrences) != len(want) {
+		t.Fatalf("expected %d occurrences, got %d", len(want), len(occurrences))
+	}
+	for i := range want {
+		if occurrences[i] != want[i] {
+			t.Fatalf("expected occurrence %s, got %s", want[i], occurrences[i])
+		}
+	}
+	occurrences, err = (&Task{RunAt: "2018-03-01T13:00:00Z"}).Preview(5)
+	if err != nil || len(occurrences) != 1 {
+		t.Fatal("expected a single occurrence of a task that does not recur")
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unixMillisThreshold is the smallest epoch value treated as
+// milliseconds rather than seconds.  Epoch seconds do not reach this
+// value until the year 33658.
+const unixMillisThreshold = 1e12
+
+// localLayout is the layout of a wall clock timestamp without a zone
+// offset.
+const localLayout = "2006-01-02T15:04:05.999999999"
+
+// legacyLayout is the layout of the run at times stored by earlier
+// versions, which kept whatever time.Time.String returned.
+const legacyLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+// ParseRunAt parses a task run at value relative to now.  The accepted
+// forms are RFC3339 and RFC3339Nano timestamps, unix epoch seconds or
+// milliseconds, and durations relative to now prefixed with a plus sign
+// such as "+15m".  Timestamps without a zone offset are wall clock times
+// and relative durations may start with a number of calendar days such
+// as "+1d" or "+2d12h".  Both are evaluated in the location of now with
+// the daylight saving rules of ResolveWallClock.
+func ParseRunAt(value string, now time.Time) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, fmt.Errorf("empty run at time")
+	}
+	if strings.HasPrefix(value, "+") {
+		t, err := parseRelative(value[1:], now)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid relative run at time %q", value)
+		}
+		return t, nil
+	}
+	if epoch, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if epoch >= unixMillisThreshold || epoch <= -unixMillisThreshold {
+			return time.UnixMilli(epoch), nil
+		}
+		return time.Unix(epoch, 0), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	wall, err := time.Parse(localLayout, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid run at time %q", value)
+	}
+	return ResolveWallClock(wall, now.Location()), nil
+}
+
+// parseStoredRunAt parses a run at value read from storage.  Besides
+// the forms accepted by ParseRunAt, the time.Time.String form stored by
+// earlier versions is accepted, with or without its monotonic clock
+// reading.
+func parseStoredRunAt(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	legacy := value
+	if i := strings.Index(legacy, " m="); i >= 0 {
+		legacy = legacy[:i]
+	}
+	if t, err := time.Parse(legacyLayout, legacy); err == nil {
+		return t, nil
+	}
+	return ParseRunAt(value, time.Now())
+}
+
+// parseRelative parses a duration relative to now with an optional
+// leading number of calendar days.
+func parseRelative(value string, now time.Time) (time.Time, error) {
+	if i := strings.IndexByte(value, 'd'); i >= 0 {
+		days, err := strconv.Atoi(value[:i])
+		if err != nil || days < 0 {
+			return time.Time{}, fmt.Errorf("invalid days %q", value[:i])
+		}
+		wall := WallClock(now, now.Location()).AddDate(0, 0, days)
+		now = ResolveWallClock(wall, now.Location())
+		if value = value[i+1:]; value == "" {
+			return now, nil
+		}
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return now.Add(d), nil
+}
+
+// FormatRunAt formats the point in time as the normalized UTC run at
+// value stored on tasks.
+func FormatRunAt(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// NormalizeRunAt parses the run at value relative to now and returns it
+// in its normalized form.
+func NormalizeRunAt(value string, now time.Time) (string, error) {
+	t, err := ParseRunAt(value, now)
+	if err != nil {
+		return "", err
+	}
+	return FormatRunAt(t), nil
+}
+
+// FormatDuration formats the duration as an ISO 8601 duration such as
+// "PT1H30M" or "PT0.25S".  Negative durations are prefixed with a minus
+// sign.
+func FormatDuration(d time.Duration) string {
+	if d == 0 {
+		return "PT0S"
+	}
+	var b strings.Builder
+	if d < 0 {
+		b.WriteByte('-')
+		d = -d
+	}
+	b.WriteString("PT")
+	if h := d / time.Hour; h > 0 {
+		fmt.Fprintf(&b, "%dH", h)
+		d -= h * time.Hour
+	}
+	if m := d / time.Minute; m > 0 {
+		fmt.Fprintf(&b, "%dM", m)
+		d -= m * time.Minute
+	}
+	if d > 0 {
+		b.WriteString(strconv.FormatFloat(d.Seconds(), 'f', -1, 64))
+		b.WriteByte('S')
+	}
+	return b.String()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRunAt(t *testing.T) {
+	now := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Time
+	}{
+		{"2018-03-01T13:30:00Z", time.Date(2018, 3, 1, 13, 30, 0, 0, time.UTC)},
+		{"2018-03-01T13:30:00+02:00", time.Date(2018, 3, 1, 11, 30, 0, 0, time.UTC)},
+		{"2018-03-01T13:30:00.123456789Z", time.Date(2018, 3, 1, 13, 30, 0, 123456789, time.UTC)},
+		{"1519907400", time.Date(2018, 3, 1, 12, 30, 0, 0, time.UTC)},
+		{"1519907400250", time.Date(2018, 3, 1, 12, 30, 0, 250000000, time.UTC)},
+		{"+15m", now.Add(time.Minute * 15)},
+		{" +1h30m ", now.Add(time.Minute * 90)},
+	}
+	for _, test := range tests {
+		got, err := ParseRunAt(test.value, now)
+		if err != nil {
+			t.Fatalf("%q: %s", test.value, err)
+		}
+		if !got.Equal(test.want) {
+			t.Fatalf("%q: expected %s, got %s", test.value, test.want, got)
+		}
+	}
+	for _, value := range []string{"", "test", "+soon", "2018-03-01 13:30:00", time.Now().String()} {
+		if _, err := ParseRunAt(value, now); err == nil {
+			t.Fatalf("%q: expected parse error", value)
+		}
+	}
+}
+
+func TestNormalizeRunAt(t *testing.T) {
+	runAt, err := NormalizeRunAt("2018-03-01T13:30:00+02:00", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runAt != "2018-03-01T11:30:00Z" {
+		t.Fatalf("expected normalized utc run at time, got %s", runAt)
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "PT0S"},
+		{time.Millisecond * 250, "PT0.25S"},
+		{time.Second * 10, "PT10S"},
+		{time.Minute*90 + time.Second, "PT1H30M1S"},
+		{time.Hour * 26, "PT26H"},
+		{-time.Minute * 5, "-PT5M"},
+	}
+	for _, test := range tests {
+		if got := FormatDuration(test.d); got != test.want {
+			t.Fatalf("%s: expected %s, got %s", test.d, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"container/heap"
+	"sort"
+	"time"
+)
+
+// scheduleItem is a task positioned in the schedule.
+type scheduleItem struct {
+	// task is the scheduled task.
+	// at is the parsed run at time of the task.
+	// seq is the insertion sequence used to order tasks sharing a run at
+	// time.
+	// index is the position of the item in the heap.
+	task  *Task
+	at    time.Time
+	seq   uint64
+	index int
+}
+
+// runsBefore reports whether the item is scheduled to run ahead of the
+// other item.  Items sharing a run at time run in the order they were
+// inserted.
+func (item *scheduleItem) runsBefore(other *scheduleItem) bool {
+	if !item.at.Equal(other.at) {
+		return item.at.Before(other.at)
+	}
+	return item.seq < other.seq
+}
+
+// taskHeap is a min heap of scheduled tasks with an index of the tasks
+// by id and a count of the tasks reserving each run at time.  Insert,
+// remove and pop are logarithmic, peek and lookups are constant.
+type taskHeap struct {
+	// items holds the heap ordered schedule items.
+	// ids indexes the schedule items by task id.
+	// slots counts the tasks at each run at time in unix nanoseconds.
+	// seq is the last insertion sequence.
+	items []*scheduleItem
+	ids   map[string]*scheduleItem
+	slots map[int64]int
+	seq   uint64
+}
+
+// Len implements heap.Interface.
+func (h *taskHeap) Len() int {
+	return len(h.items)
+}
+
+// Less implements heap.Interface.
+func (h *taskHeap) Less(i, j int) bool {
+	return h.items[i].runsBefore(h.items[j])
+}
+
+// Swap implements heap.Interface.
+func (h *taskHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.items[i].index = i
+	h.items[j].index = j
+}
+
+// Push implements heap.Interface.
+func (h *taskHeap) Push(x interface{}) {
+	item := x.(*scheduleItem)
+	item.index = len(h.items)
+	h.items = append(h.items, item)
+}
+
+// Pop implements heap.Interface.
+func (h *taskHeap) Pop() interface{} {
+	n := len(h.items) - 1
+	item := h.items[n]
+	h.items[n] = nil
+	h.items = h.items[:n]
+	item.index = -1
+	return item
+}
+
+// add schedules the task to run at the provided time.
+func (h *taskHeap) add(task *Task, at time.Time) {
+	h.seq++
+	item := &scheduleItem{task: task, at: at, seq: h.seq}
+	heap.Push(h, item)
+	h.ids[task.Id] = item
+	h.slots[at.UnixNano()]++
+}
+
+// get returns the scheduled task with the matching id.
+func (h *taskHeap) get(id string) (*Task, bool) {
+	item, ok := h.ids[id]
+	if !ok {
+		return nil, false
+	}
+	return item.task, true
+}
+
+// peek returns the first item to run without removing it.
+func (h *taskHeap) peek() *scheduleItem {
+	if len(h.items) == 0 {
+		return nil
+	}
+	return h.items[0]
+}
+
+// pop removes and returns the first item to run.
+func (h *taskHeap) pop() *scheduleItem {
+	if len(h.items) == 0 {
+		return nil
+	}
+	item := heap.Pop(h).(*scheduleItem)
+	h.forget(item)
+	return item
+}
+
+// remove deletes the task with the matching id from the schedule.
+func (h *taskHeap) remove(id string) (*scheduleItem, bool) {
+	item, ok := h.ids[id]
+	if !ok {
+		return nil, false
+	}
+	heap.Remove(h, item.index)
+	h.forget(item)
+	return item, true
+}
+
+// due returns the items that are due at the provided time in heap order.
+// Only the due items and their direct children are visited.
+func (h *taskHeap) due(now time.Time) []*scheduleItem {
+	items := make([]*scheduleItem, 0)
+	stack := []int{0}
+	for len(stack) > 0 {
+		i := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if i >= len(h.items) || !now.After(h.items[i].at) {
+			continue
+		}
+		items = append(items, h.items[i])
+		stack = append(stack, 2*i+2, 2*i+1)
+	}
+	return items
+}
+
+// reserved reports whether a task is scheduled at the provided time.
+func (h *taskHeap) reserved(at time.Time) bool {
+	return h.slots[at.UnixNano()] > 0
+}
+
+// reservation returns the first task scheduled at the provided time.  The
+// schedule is scanned, so it is only meant for reporting conflicts.
+func (h *taskHeap) reservation(at time.Time) *Task {
+	if !h.reserved(at) {
+		return nil
+	}
+	var first *scheduleItem
+	for _, item := range h.items {
+		if item.at.Equal(at) && (first == nil || item.seq < first.seq) {
+			first = item
+		}
+	}
+	return first.task
+}
+
+// sorted returns the scheduled tasks in the order they run.
+func (h *taskHeap) sorted() []*Task {
+	items := make([]*scheduleItem, len(h.items))
+	copy(items, h.items)
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].runsBefore(items[j])
+	})
+	tasks := make([]*Task, len(items))
+	for i, item := range items {
+		tasks[i] = item.task
+	}
+	return tasks
+}
+
+// forget drops the item from the id index and run at time slots.
+func (h *taskHeap) forget(item *scheduleItem) {
+	delete(h.ids, item.task.Id)
+	slot := item.at.UnixNano()
+	if h.slots[slot]--; h.slots[slot] <= 0 {
+		delete(h.slots, slot)
+	}
+}
+
+// newTaskHeap creates an empty task heap.
+func newTaskHeap() *taskHeap {
+	return &taskHeap{
+		items: make([]*scheduleItem, 0),
+		ids:   make(map[string]*scheduleItem),
+		slots: make(map[int64]int),
+	}
+}
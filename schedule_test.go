@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTaskHeapOrder(t *testing.T) {
+	h := newTaskHeap()
+	now := time.Now()
+	h.add(&Task{Id: "3"}, now.Add(time.Minute))
+	h.add(&Task{Id: "1"}, now)
+	h.add(&Task{Id: "4"}, now.Add(time.Minute))
+	h.add(&Task{Id: "2"}, now)
+	for _, id := range []string{"1", "2", "3", "4"} {
+		if item := h.pop(); item.task.Id != id {
+			t.Fatalf("expected task %s, got %s", id, item.task.Id)
+		}
+	}
+	if h.pop() != nil {
+		t.Fatal("expected empty heap")
+	}
+}
+
+func TestTaskHeapRemove(t *testing.T) {
+	h := newTaskHeap()
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		h.add(&Task{Id: fmt.Sprint(i)}, now.Add(time.Duration(i)*time.Second))
+	}
+	if _, ok := h.remove("0"); !ok {
+		t.Fatal("expected task 0 to be removed")
+	}
+	if _, ok := h.remove("5"); !ok {
+		t.Fatal("expected task 5 to be removed")
+	}
+	if _, ok := h.remove("5"); ok {
+		t.Fatal("expected task 5 to be gone")
+	}
+	if h.reserved(now) {
+		t.Fatal("expected run at time slot to be released")
+	}
+	if !h.reserved(now.Add(time.Second)) {
+		t.Fatal("expected run at time slot to be reserved")
+	}
+	if task := h.reservation(now.Add(time.Second)); task == nil || task.Id != "1" {
+		t.Fatal("expected task 1 to reserve the run at time slot")
+	}
+	if task := h.reservation(now); task != nil {
+		t.Fatal("expected no task to reserve the released slot")
+	}
+	tasks := h.sorted()
+	if len(tasks) != 8 || tasks[0].Id != "1" || tasks[4].Id != "6" {
+		t.Fatal("got unexpected schedule order")
+	}
+}
+
+func TestTaskHeapDue(t *testing.T) {
+	h := newTaskHeap()
+	now := time.Now()
+	for i := 0; i < 20; i++ {
+		h.add(&Task{Id: fmt.Sprint(i)}, now.Add(time.Duration(i-10)*time.Second))
+	}
+	due := h.due(now)
+	if len(due) != 10 {
+		t.Fatalf("expected 10 due tasks, got %d", len(due))
+	}
+	for _, item := range due {
+		if !now.After(item.at) {
+			t.Fatalf("expected task %s to be due", item.task.Id)
+		}
+	}
+	if len(newTaskHeap().due(now)) != 0 {
+		t.Fatal("expected no due tasks")
+	}
+}
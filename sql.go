@@ -0,0 +1,659 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	SQLDriverPostgres = "postgres" // the postgresql database/sql driver name.
+	SQLDriverSQLite   = "sqlite3"  // the sqlite database/sql driver name.
+)
+
+// sqlMigrations are the schema migrations of the sql model.  Each
+// migration is applied once in its own transaction and its version is
+// its position in the list plus one.
+var sqlMigrations = [][]string{
+	{
+		`CREATE TABLE timetables (
+			timetable_key TEXT PRIMARY KEY,
+			exclusive BOOLEAN NOT NULL DEFAULT FALSE,
+			time_zone TEXT NOT NULL DEFAULT '',
+			callback TEXT,
+			deliveries TEXT
+		)`,
+		`CREATE TABLE tasks (
+			timetable_key TEXT NOT NULL REFERENCES timetables (timetable_key),
+			id TEXT NOT NULL,
+			run_at BIGINT NOT NULL,
+			seq BIGINT NOT NULL,
+			data TEXT NOT NULL,
+			lease_worker_id TEXT,
+			lease_token TEXT,
+			lease_expires_at TEXT,
+			PRIMARY KEY (timetable_key, id)
+		)`,
+		`CREATE INDEX tasks_timetable_key_run_at ON tasks (timetable_key, run_at)`,
+	},
+	{
+		`ALTER TABLE timetables ADD COLUMN rev BIGINT NOT NULL DEFAULT 0`,
+	},
+	{
+		`CREATE TABLE locks (
+			name TEXT PRIMARY KEY,
+			owner TEXT NOT NULL,
+			expires_at BIGINT NOT NULL
+		)`,
+	},
+	{
+		`ALTER TABLE timetables ADD COLUMN task_order TEXT NOT NULL DEFAULT ''`,
+	},
+}
+
+// sqlTaskRow is a row of the tasks table.  Scheduled tasks have no
+// lease columns.
+type sqlTaskRow struct {
+	runAt          int64
+	data           string
+	leaseWorkerId  sql.NullString
+	leaseToken     sql.NullString
+	leaseExpiresAt sql.NullString
+}
+
+// newSQLTaskRow returns the row of the task and its optional lease.
+func newSQLTaskRow(task *Task, lease *Lease) (*sqlTaskRow, error) {
+	at, err := time.Parse(time.RFC3339, task.RunAt)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(task)
+	if err != nil {
+		return nil, err
+	}
+	row := &sqlTaskRow{runAt: at.UnixNano(), data: string(data)}
+	if lease != nil {
+		row.leaseWorkerId = sql.NullString{String: lease.WorkerId, Valid: true}
+		row.leaseToken = sql.NullString{String: lease.Token, Valid: true}
+		row.leaseExpiresAt = sql.NullString{String: lease.ExpiresAt.UTC().Format(time.RFC3339Nano), Valid: true}
+	}
+	return row, nil
+}
+
+// sqlSnapshot holds the task rows of a timetable as the model last read
+// or wrote them at a revision.
+type sqlSnapshot struct {
+	// rev is the revision of the timetable.
+	// rows holds the task rows keyed on task id.
+	// seq is at least the highest task sequence number.
+	rev  string
+	rows map[string]*sqlTaskRow
+	seq  int64
+}
+
+// SQLModel stores timetables in a PostgreSQL or SQLite database.  Each
+// task is kept in its own row of the tasks table indexed by timetable
+// key and run at time, so saving a timetable only writes the tasks that
+// changed.  The task rows are compared with a snapshot of the rows the
+// model last read or wrote, and only read back from the database if the
+// timetable was changed elsewhere since.
+type SQLModel struct {
+	// driver is the database/sql driver name.
+	// db is the database handle.
+	// snapshots holds the task rows snapshot of each timetable.
+	// mu guards the snapshots.
+	driver    string
+	db        *sql.DB
+	snapshots map[string]*sqlSnapshot
+	mu        sync.Mutex
+}
+
+// Close closes the database handle.
+func (model *SQLModel) Close() error {
+	return model.db.Close()
+}
+
+// Create applies the schema migrations that have not been applied yet.
+func (model *SQLModel) Create() error {
+	_, err := model.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`)
+	if err != nil {
+		return err
+	}
+	var version int
+	err = model.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	if err != nil {
+		return err
+	}
+	for ; version < len(sqlMigrations); version++ {
+		tx, err := model.db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, statement := range sqlMigrations[version] {
+			if _, err := tx.Exec(statement); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migration %d: %s", version+1, err)
+			}
+		}
+		if _, err := tx.Exec(model.rebind(`INSERT INTO schema_migrations (version) VALUES (?)`), version+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Fetch gets the timetable with the provided key.
+func (model *SQLModel) Fetch(key string) (interface{}, error) {
+	timetables, err := model.fetch(false, `WHERE timetable_key = ?`, key)
+	if err != nil || len(timetables) == 0 {
+		return nil, err
+	}
+	return timetables[0], nil
+}
+
+// FetchAll gets all timetables ordered by key.
+func (model *SQLModel) FetchAll() ([]interface{}, error) {
+	return model.fetch(true, "")
+}
+
+// fetch gets the timetables matched by the where clause ordered by key.
+// Timetables that cannot be decoded are logged and skipped if skip is
+// set and fail the fetch otherwise.
+func (model *SQLModel) fetch(skip bool, where string, args ...interface{}) ([]interface{}, error) {
+	keys := make([]string, 0)
+	tables := make(map[string]*Timetable)
+	bad := make(map[string]error)
+	rows, err := model.db.Query(model.rebind(`
+		SELECT timetable_key, exclusive, time_zone, task_order, callback, deliveries, rev
+		FROM timetables `+where+` ORDER BY timetable_key`), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		var rev int64
+		var callback, deliveries sql.NullString
+		table := NewTimetable("")
+		if err := rows.Scan(&key, &table.Exclusive, &table.TimeZone, &table.Order, &callback, &deliveries, &rev); err != nil {
+			return nil, err
+		}
+		table.Key = key
+		table.rev = strconv.FormatInt(rev, 10)
+		keys = append(keys, key)
+		tables[key] = table
+		if callback.Valid {
+			if err := json.Unmarshal([]byte(callback.String), &table.Callback); err != nil {
+				bad[key] = err
+				continue
+			}
+		}
+		if deliveries.Valid {
+			if err := json.Unmarshal([]byte(deliveries.String), &table.deliveries); err != nil {
+				bad[key] = err
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	snapshots := make(map[string]*sqlSnapshot)
+	for key, table := range tables {
+		snapshots[key] = &sqlSnapshot{rev: table.rev, rows: make(map[string]*sqlTaskRow)}
+	}
+	rows, err = model.db.Query(model.rebind(`
+		SELECT timetable_key, id, run_at, seq, data, lease_worker_id, lease_token, lease_expires_at
+		FROM tasks `+where+` ORDER BY timetable_key, run_at, seq`), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key, id string
+		var seq int64
+		row := new(sqlTaskRow)
+		if err := rows.Scan(&key, &id, &row.runAt, &seq, &row.data, &row.leaseWorkerId, &row.leaseToken, &row.leaseExpiresAt); err != nil {
+			return nil, err
+		}
+		table, ok := tables[key]
+		if !ok {
+			return nil, fmt.Errorf("task of unknown timetable %q", key)
+		}
+		if bad[key] != nil {
+			continue
+		}
+		snapshot := snapshots[key]
+		snapshot.rows[id] = row
+		if seq > snapshot.seq {
+			snapshot.seq = seq
+		}
+		task := new(Task)
+		if err := json.Unmarshal([]byte(row.data), task); err != nil {
+			bad[key] = err
+			continue
+		}
+		if row.leaseToken.Valid {
+			expiresAt, err := time.Parse(time.RFC3339Nano, row.leaseExpiresAt.String)
+			if err != nil {
+				bad[key] = err
+				continue
+			}
+			table.leases[task.Id] = &Lease{
+				Task:      task,
+				WorkerId:  row.leaseWorkerId.String,
+				Token:     row.leaseToken.String,
+				ExpiresAt: expiresAt,
+			}
+			continue
+		}
+		at, err := parseStoredRunAt(task.RunAt)
+		if err != nil {
+			bad[key] = err
+			continue
+		}
+		table.schedule.add(task, at)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	timetables := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		if err := bad[key]; err != nil {
+			if !skip {
+				return nil, fmt.Errorf("timetable %q: %s", key, err)
+			}
+			log.Printf("skipping timetable %s: %s", key, err)
+			continue
+		}
+		timetables = append(timetables, tables[key])
+		model.keep(key, snapshots[key])
+	}
+	return timetables, nil
+}
+
+// Save writes the timetable settings and the tasks that were added,
+// changed or removed since the timetable was last saved.  The timetable
+// is only created if it has no revision and only updated if its
+// revision matches the stored revision.
+func (model *SQLModel) Save(table interface{}) (DocumentMeta, error) {
+	timetable := table.(*Timetable)
+	var callback, deliveries sql.NullString
+	if timetable.Callback != nil {
+		data, err := json.Marshal(timetable.Callback)
+		if err != nil {
+			return DocumentMeta{}, err
+		}
+		callback = sql.NullString{String: string(data), Valid: true}
+	}
+	if len(timetable.deliveries) > 0 {
+		data, err := json.Marshal(timetable.deliveries)
+		if err != nil {
+			return DocumentMeta{}, err
+		}
+		deliveries = sql.NullString{String: string(data), Valid: true}
+	}
+	ids := make([]string, 0)
+	want := make(map[string]*sqlTaskRow)
+	for _, task := range timetable.List() {
+		row, err := newSQLTaskRow(task, nil)
+		if err != nil {
+			return DocumentMeta{}, err
+		}
+		ids = append(ids, task.Id)
+		want[task.Id] = row
+	}
+	for _, lease := range timetable.Leases() {
+		row, err := newSQLTaskRow(lease.Task, lease)
+		if err != nil {
+			return DocumentMeta{}, err
+		}
+		ids = append(ids, lease.Task.Id)
+		want[lease.Task.Id] = row
+	}
+	// the snapshot is taken over by the save and replaced once the save
+	// is committed.
+	snapshot := model.take(timetable.Key, timetable.rev)
+
+	tx, err := model.db.Begin()
+	if err != nil {
+		return DocumentMeta{}, err
+	}
+	defer tx.Rollback()
+	var rev int64
+	var res sql.Result
+	if timetable.rev == "" {
+		res, err = tx.Exec(model.rebind(`
+			INSERT INTO timetables (timetable_key, exclusive, time_zone, task_order, callback, deliveries, rev)
+			VALUES (?, ?, ?, ?, ?, ?, 1)
+			ON CONFLICT (timetable_key) DO NOTHING`),
+			timetable.Key, timetable.Exclusive, timetable.TimeZone, timetable.Order, callback, deliveries,
+		)
+	} else {
+		if rev, err = strconv.ParseInt(timetable.rev, 10, 64); err != nil {
+			return DocumentMeta{}, ErrRevisionConflict
+		}
+		res, err = tx.Exec(model.rebind(`
+			UPDATE timetables SET
+				exclusive = ?,
+				time_zone = ?,
+				task_order = ?,
+				callback = ?,
+				deliveries = ?,
+				rev = rev + 1
+			WHERE timetable_key = ? AND rev = ?`),
+			timetable.Exclusive, timetable.TimeZone, timetable.Order, callback, deliveries, timetable.Key, rev,
+		)
+	}
+	if err != nil {
+		return DocumentMeta{}, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return DocumentMeta{}, err
+	} else if n == 0 {
+		return DocumentMeta{}, ErrRevisionConflict
+	}
+	if snapshot == nil {
+		if snapshot, err = model.taskRows(tx, timetable.Key); err != nil {
+			return DocumentMeta{}, err
+		}
+	}
+	have, seq := snapshot.rows, snapshot.seq
+	for _, id := range ids {
+		row := want[id]
+		old, ok := have[id]
+		switch {
+		case !ok:
+			seq++
+			_, err = tx.Exec(model.rebind(`
+				INSERT INTO tasks (timetable_key, id, run_at, seq, data, lease_worker_id, lease_token, lease_expires_at)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?)`),
+				timetable.Key, id, row.runAt, seq, row.data, row.leaseWorkerId, row.leaseToken, row.leaseExpiresAt,
+			)
+		case *old != *row:
+			// a task moved to another run at time runs after the tasks
+			// already sharing it.
+			seq++
+			_, err = tx.Exec(model.rebind(`
+				UPDATE tasks SET
+					run_at = ?,
+					seq = CASE WHEN run_at = ? THEN seq ELSE ? END,
+					data = ?,
+					lease_worker_id = ?,
+					lease_token = ?,
+					lease_expires_at = ?
+				WHERE timetable_key = ? AND id = ?`),
+				row.runAt, row.runAt, seq, row.data, row.leaseWorkerId, row.leaseToken, row.leaseExpiresAt, timetable.Key, id,
+			)
+		}
+		if err != nil {
+			return DocumentMeta{}, err
+		}
+	}
+	for id := range have {
+		if _, ok := want[id]; ok {
+			continue
+		}
+		_, err := tx.Exec(model.rebind(`DELETE FROM tasks WHERE timetable_key = ? AND id = ?`), timetable.Key, id)
+		if err != nil {
+			return DocumentMeta{}, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return DocumentMeta{}, err
+	}
+	timetable.rev = strconv.FormatInt(rev+1, 10)
+	model.keep(timetable.Key, &sqlSnapshot{rev: timetable.rev, rows: want, seq: seq})
+	return documentMeta(timetable.Key), nil
+}
+
+// InsertTask stores the task as scheduled in its row.
+func (model *SQLModel) InsertTask(key string, rev string, task *Task) (string, error) {
+	row, err := newSQLTaskRow(task, nil)
+	if err != nil {
+		return "", err
+	}
+	return model.putTask(key, rev, task.Id, row)
+}
+
+// RemoveTask deletes the row of the task.
+func (model *SQLModel) RemoveTask(key string, rev string, id string) (string, error) {
+	tx, err := model.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	next, err := model.bump(tx, key, rev)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(model.rebind(`DELETE FROM tasks WHERE timetable_key = ? AND id = ?`), key, id)
+	if err != nil {
+		return "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	model.patch(key, rev, next, id, nil, 0)
+	return next, nil
+}
+
+// ClaimTask stores the leased task as claimed in its row.
+func (model *SQLModel) ClaimTask(key string, rev string, lease *Lease) (string, error) {
+	row, err := newSQLTaskRow(lease.Task, lease)
+	if err != nil {
+		return "", err
+	}
+	return model.putTask(key, rev, lease.Task.Id, row)
+}
+
+// putTask writes the row of the task and bumps the timetable revision
+// from rev.  A task moved to another run at time runs after the tasks already
+// sharing it.
+func (model *SQLModel) putTask(key string, rev string, id string, row *sqlTaskRow) (string, error) {
+	tx, err := model.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	next, err := model.bump(tx, key, rev)
+	if err != nil {
+		return "", err
+	}
+	var seq int64
+	err = tx.QueryRow(model.rebind(`SELECT COALESCE(MAX(seq), 0) + 1 FROM tasks WHERE timetable_key = ?`), key).Scan(&seq)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(model.rebind(`
+		INSERT INTO tasks (timetable_key, id, run_at, seq, data, lease_worker_id, lease_token, lease_expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (timetable_key, id) DO UPDATE SET
+			run_at = excluded.run_at,
+			seq = CASE WHEN tasks.run_at = excluded.run_at THEN tasks.seq ELSE excluded.seq END,
+			data = excluded.data,
+			lease_worker_id = excluded.lease_worker_id,
+			lease_token = excluded.lease_token,
+			lease_expires_at = excluded.lease_expires_at`),
+		key, id, row.runAt, seq, row.data, row.leaseWorkerId, row.leaseToken, row.leaseExpiresAt,
+	)
+	if err != nil {
+		return "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	model.patch(key, rev, next, id, row, seq)
+	return next, nil
+}
+
+// bump increments the revision of the timetable if it is rev and returns
+// the new revision.  The timetable is created if rev is empty.
+// ErrRevisionConflict is returned if the stored revision differs.
+func (model *SQLModel) bump(tx *sql.Tx, key string, rev string) (string, error) {
+	var n int64
+	var res sql.Result
+	var err error
+	if rev == "" {
+		res, err = tx.Exec(model.rebind(`
+			INSERT INTO timetables (timetable_key, rev) VALUES (?, 1)
+			ON CONFLICT (timetable_key) DO NOTHING`), key)
+	} else {
+		if n, err = strconv.ParseInt(rev, 10, 64); err != nil {
+			return "", ErrRevisionConflict
+		}
+		res, err = tx.Exec(model.rebind(`
+			UPDATE timetables SET rev = rev + 1
+			WHERE timetable_key = ? AND rev = ?`), key, n)
+	}
+	if err != nil {
+		return "", err
+	}
+	if affected, err := res.RowsAffected(); err != nil {
+		return "", err
+	} else if affected == 0 {
+		return "", ErrRevisionConflict
+	}
+	return strconv.FormatInt(n+1, 10), nil
+}
+
+// AcquireLock takes or renews the named lock for the owner.
+func (model *SQLModel) AcquireLock(name string, owner string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	res, err := model.db.Exec(model.rebind(`
+		INSERT INTO locks (name, owner, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET
+			owner = excluded.owner,
+			expires_at = excluded.expires_at
+		WHERE locks.owner = excluded.owner OR locks.expires_at <= ?`),
+		name, owner, now.Add(ttl).UnixNano(), now.UnixNano(),
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ReleaseLock deletes the named lock if the owner holds it.
+func (model *SQLModel) ReleaseLock(name string, owner string) error {
+	_, err := model.db.Exec(model.rebind(`DELETE FROM locks WHERE name = ? AND owner = ?`), name, owner)
+	return err
+}
+
+// taskRows reads the stored task rows of the timetable into a snapshot
+// without a revision.
+func (model *SQLModel) taskRows(tx *sql.Tx, key string) (*sqlSnapshot, error) {
+	rows, err := tx.Query(model.rebind(`
+		SELECT id, run_at, seq, data, lease_worker_id, lease_token, lease_expires_at
+		FROM tasks WHERE timetable_key = ?`), key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	snapshot := &sqlSnapshot{rows: make(map[string]*sqlTaskRow)}
+	for rows.Next() {
+		var id string
+		var seq int64
+		row := new(sqlTaskRow)
+		if err := rows.Scan(&id, &row.runAt, &seq, &row.data, &row.leaseWorkerId, &row.leaseToken, &row.leaseExpiresAt); err != nil {
+			return nil, err
+		}
+		if seq > snapshot.seq {
+			snapshot.seq = seq
+		}
+		snapshot.rows[id] = row
+	}
+	return snapshot, rows.Err()
+}
+
+// take removes the task rows snapshot of the timetable and returns it if
+// it is at the revision.
+func (model *SQLModel) take(key string, rev string) *sqlSnapshot {
+	model.mu.Lock()
+	defer model.mu.Unlock()
+	snapshot := model.snapshots[key]
+	delete(model.snapshots, key)
+	if snapshot == nil || snapshot.rev != rev {
+		return nil
+	}
+	return snapshot
+}
+
+// keep stores the task rows snapshot of the timetable.
+func (model *SQLModel) keep(key string, snapshot *sqlSnapshot) {
+	model.mu.Lock()
+	defer model.mu.Unlock()
+	model.snapshots[key] = snapshot
+}
+
+// patch applies a task write that moved the timetable from rev to next
+// to its task rows snapshot.  A nil row is a removed task.  The snapshot
+// is dropped if it is not at rev.
+func (model *SQLModel) patch(key string, rev string, next string, id string, row *sqlTaskRow, seq int64) {
+	model.mu.Lock()
+	defer model.mu.Unlock()
+	snapshot := model.snapshots[key]
+	if snapshot == nil || snapshot.rev != rev {
+		delete(model.snapshots, key)
+		return
+	}
+	if row == nil {
+		delete(snapshot.rows, id)
+	} else {
+		snapshot.rows[id] = row
+	}
+	if seq > snapshot.seq {
+		snapshot.seq = seq
+	}
+	snapshot.rev = next
+}
+
+// rebind replaces the ? placeholders of the query with the numbered
+// placeholders used by postgresql.
+func (model *SQLModel) rebind(query string) string {
+	if model.driver != SQLDriverPostgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// NewSQLModel opens a sql model on the database of the driver and data
+// source name.
+func NewSQLModel(driver string, source string) (*SQLModel, error) {
+	if driver != SQLDriverPostgres && driver != SQLDriverSQLite {
+		return nil, fmt.Errorf("unsupported sql driver %q", driver)
+	}
+	db, err := sql.Open(driver, source)
+	if err != nil {
+		return nil, err
+	}
+	if driver == SQLDriverSQLite {
+		// sqlite allows a single writer.
+		db.SetMaxOpenConns(1)
+	}
+	return &SQLModel{driver: driver, db: db, snapshots: make(map[string]*sqlSnapshot)}, nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestSQLModel opens a sqlite model on the database file at path and
+// closes it when the test ends.
+func newTestSQLModel(t *testing.T, path string) *SQLModel {
+	model, err := NewSQLModel(SQLDriverSQLite, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { model.Close() })
+	return model
+}
+
+func TestSQLModelConformance(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "timetables.db")
+	testModelConformance(t, func() Model { return newTestSQLModel(t, path) })
+	testTaskModelConformance(t, newTestSQLModel(t, path))
+	testRevisionConformance(t, newTestSQLModel(t, path))
+}
+
+func TestSQLModelPostgresConformance(t *testing.T) {
+	source := os.Getenv("POSTGRES_DSN")
+	if testing.Short() || source == "" {
+		t.Skip("skipping integration test")
+	}
+	testModelConformance(t, func() Model {
+		model, err := NewSQLModel(SQLDriverPostgres, source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { model.Close() })
+		return model
+	})
+	model, err := NewSQLModel(SQLDriverPostgres, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer model.Close()
+	testTaskModelConformance(t, model)
+	testRevisionConformance(t, model)
+}
+
+func TestSQLModelCreate(t *testing.T) {
+	model := newTestSQLModel(t, filepath.Join(t.TempDir(), "timetables.db"))
+	for i := 0; i < 2; i++ {
+		if err := model.Create(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var version int
+	if err := model.db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version != len(sqlMigrations) {
+		t.Fatalf("expected schema version %d, got %d", len(sqlMigrations), version)
+	}
+	var index string
+	err := model.db.QueryRow(`SELECT sql FROM sqlite_master WHERE name = 'tasks_timetable_key_run_at'`).Scan(&index)
+	if err != nil {
+		t.Fatal("expected the tasks run at index to exist")
+	}
+}
+
+func TestSQLModelSave(t *testing.T) {
+	model := newTestSQLModel(t, filepath.Join(t.TempDir(), "timetables.db"))
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	runAt := now.Add(time.Minute).Format(time.RFC3339)
+	timetable := NewTimetable("test")
+	timetable.Insert(&Task{Id: "b", RunAt: runAt})
+	timetable.Insert(&Task{Id: "a", RunAt: runAt})
+	timetable.Insert(&Task{Id: "c", RunAt: now.Add(time.Hour).Format(time.RFC3339)})
+	if _, err := model.Save(timetable); err != nil {
+		t.Fatal(err)
+	}
+	seqs := func() map[string]int64 {
+		rows, err := model.db.Query(`SELECT id, seq FROM tasks WHERE timetable_key = 'test'`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		seqs := make(map[string]int64)
+		for rows.Next() {
+			var id string
+			var seq int64
+			if err := rows.Scan(&id, &seq); err != nil {
+				t.Fatal(err)
+			}
+			seqs[id] = seq
+		}
+		return seqs
+	}
+	before := seqs()
+
+	// only the changed rows are written.
+	timetable.Remove("c")
+	timetable.Insert(&Task{Id: "d", RunAt: runAt})
+	if _, err := model.Save(timetable); err != nil {
+		t.Fatal(err)
+	}
+	after := seqs()
+	if _, ok := after["c"]; ok {
+		t.Fatal("expected task c to be deleted")
+	}
+	if after["a"] != before["a"] || after["b"] != before["b"] || after["d"] <= after["a"] {
+		t.Fatalf("expected unchanged rows to keep their sequence, got %v and %v", before, after)
+	}
+
+	timetables, err := model.FetchAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tasks := timetables[0].(*Timetable).List()
+	if len(tasks) != 3 || tasks[0].Id != "b" || tasks[1].Id != "a" || tasks[2].Id != "d" {
+		t.Fatal("expected tasks sharing a run at time to keep their insertion order")
+	}
+}
+
+func TestSQLModelSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "timetables.db")
+	model := newTestSQLModel(t, path)
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	runAt := time.Now().Add(time.Hour).Format(time.RFC3339)
+	timetable := NewTimetable("test")
+	timetable.Insert(&Task{Id: "a", RunAt: runAt})
+	if _, err := model.Save(timetable); err != nil {
+		t.Fatal(err)
+	}
+	timetable.Insert(&Task{Id: "b", RunAt: runAt})
+	if err := timetable.SaveTasks(model, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if snapshot := model.snapshots["test"]; snapshot == nil || snapshot.rev != timetable.rev || len(snapshot.rows) != 2 {
+		t.Fatal("expected the snapshot to follow the saves of the model")
+	}
+
+	// the rows are not read back while the snapshot is current.
+	if _, err := model.db.Exec(`DELETE FROM tasks WHERE id = 'a'`); err != nil {
+		t.Fatal(err)
+	}
+	timetable.TimeZone = "UTC"
+	if _, err := model.Save(timetable); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := model.db.QueryRow(`SELECT COUNT(*) FROM tasks WHERE timetable_key = 'test'`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected the unchanged row not to be written, got %d rows", n)
+	}
+
+	// a write by another replica makes the snapshot stale.
+	other := newTestSQLModel(t, path)
+	v, err := other.Fetch("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.(*Timetable).Insert(&Task{Id: "c", RunAt: runAt})
+	if _, err := other.Save(v); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := model.Save(timetable); err != ErrRevisionConflict {
+		t.Fatalf("expected revision conflict, got %v", err)
+	}
+	v, err = model.Fetch("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	timetable = v.(*Timetable)
+	timetable.Insert(&Task{Id: "d", RunAt: runAt})
+	if _, err := model.Save(timetable); err != nil {
+		t.Fatal(err)
+	}
+	v, err = other.Fetch("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tasks := v.(*Timetable).List(); len(tasks) != 3 || tasks[0].Id != "b" || tasks[1].Id != "c" || tasks[2].Id != "d" {
+		t.Fatal("expected the tasks of both replicas to be stored")
+	}
+}
+
+func TestSQLModelRebind(t *testing.T) {
+	model := &SQLModel{driver: SQLDriverPostgres}
+	if query := model.rebind(`SELECT ? WHERE a = ? AND b = ?`); query != `SELECT $1 WHERE a = $2 AND b = $3` {
+		t.Fatalf("unexpected query %s", query)
+	}
+	model.driver = SQLDriverSQLite
+	if query := model.rebind(`SELECT ?`); query != `SELECT ?` {
+		t.Fatalf("unexpected query %s", query)
+	}
+}
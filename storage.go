@@ -0,0 +1,434 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	arango "github.com/arangodb/go-driver"
+)
+
+const (
+	StorageArangoDB = "arangodb" // the arangodb storage backend.
+	StorageFile     = "file"     // the json file storage backend.
+	StorageMemory   = "memory"   // the in memory storage backend.
+	StoragePostgres = "postgres" // the postgresql storage backend.
+	StorageSQLite   = "sqlite"   // the sqlite storage backend.
+)
+
+const (
+	DefaultStoragePath = "timetables"    // the default directory of the file storage backend.
+	DefaultSQLitePath  = "timetables.db" // the default database file of the sqlite storage backend.
+)
+
+// NewModel returns the timetable model of the named storage backend with
+// its collections created.  The arangodb backend is used if the name is
+// empty.  The file backend stores its documents in the directory at
+// path, or DefaultStoragePath if the path is empty.  The path of the sql
+// backends is the data source name of the database.
+func NewModel(storage string, path string) (Model, error) {
+	var model Model
+	var err error
+	switch storage {
+	case "", StorageArangoDB:
+		InitDatabase()
+		return &TimetableModel{}, nil
+	case StorageFile:
+		if path == "" {
+			path = DefaultStoragePath
+		}
+		model = NewFileModel(path)
+	case StorageMemory:
+		model = NewMemoryModel()
+	case StoragePostgres:
+		if model, err = NewSQLModel(SQLDriverPostgres, path); err != nil {
+			return nil, err
+		}
+	case StorageSQLite:
+		if path == "" {
+			path = DefaultSQLitePath
+		}
+		if model, err = NewSQLModel(SQLDriverSQLite, path); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", storage)
+	}
+	if err := model.Create(); err != nil {
+		return nil, err
+	}
+	return model, nil
+}
+
+// documentMeta returns the document meta data of the timetable with the
+// provided key.
+func documentMeta(key string) DocumentMeta {
+	return DocumentMeta{Id: arango.DocumentID(CollectionTimetables + "/" + key)}
+}
+
+// decodeTimetables decodes the timetable documents in the order given.
+// Documents that cannot be decoded are logged under their name and
+// skipped.
+func decodeTimetables(names []string, docs [][]byte) []interface{} {
+	timetables := make([]interface{}, 0, len(docs))
+	for i, data := range docs {
+		t := new(Timetable)
+		if err := json.Unmarshal(data, t); err != nil {
+			log.Printf("skipping timetable %s: %s", names[i], err)
+			continue
+		}
+		timetables = append(timetables, t)
+	}
+	return timetables
+}
+
+// memoryLock is a named lock held by the memory model.
+type memoryLock struct {
+	owner     string
+	expiresAt time.Time
+}
+
+// MemoryModel keeps the timetables in memory.  The timetables are lost
+// when the process exits.
+type MemoryModel struct {
+	// docs holds the serialized timetables keyed on the timetable key.
+	// revs holds the revision of each timetable.
+	// locks holds the named locks.
+	// mu guards the documents and locks.
+	docs  map[string][]byte
+	revs  map[string]int
+	locks map[string]memoryLock
+	mu    sync.RWMutex
+}
+
+// AcquireLock takes or renews the named lock for the owner.
+func (model *MemoryModel) AcquireLock(name string, owner string, ttl time.Duration) (bool, error) {
+	model.mu.Lock()
+	defer model.mu.Unlock()
+	now := time.Now()
+	if lock, ok := model.locks[name]; ok && lock.owner != owner && now.Before(lock.expiresAt) {
+		return false, nil
+	}
+	model.locks[name] = memoryLock{owner: owner, expiresAt: now.Add(ttl)}
+	return true, nil
+}
+
+// ReleaseLock releases the named lock if the owner holds it.
+func (model *MemoryModel) ReleaseLock(name string, owner string) error {
+	model.mu.Lock()
+	defer model.mu.Unlock()
+	if lock, ok := model.locks[name]; ok && lock.owner == owner {
+		delete(model.locks, name)
+	}
+	return nil
+}
+
+// Create is a no-op for the memory model.
+func (model *MemoryModel) Create() error {
+	return nil
+}
+
+// Fetch gets the stored timetable with the provided key.
+func (model *MemoryModel) Fetch(key string) (interface{}, error) {
+	model.mu.RLock()
+	defer model.mu.RUnlock()
+	data, ok := model.docs[key]
+	if !ok {
+		return nil, nil
+	}
+	t := new(Timetable)
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, err
+	}
+	t.rev = strconv.Itoa(model.revs[key])
+	return t, nil
+}
+
+// FetchAll gets all stored timetables ordered by key.
+func (model *MemoryModel) FetchAll() ([]interface{}, error) {
+	model.mu.RLock()
+	defer model.mu.RUnlock()
+	keys := make([]string, 0, len(model.docs))
+	for key := range model.docs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	docs := make([][]byte, len(keys))
+	for i, key := range keys {
+		docs[i] = model.docs[key]
+	}
+	timetables := decodeTimetables(keys, docs)
+	for _, t := range timetables {
+		t.(*Timetable).rev = strconv.Itoa(model.revs[t.(*Timetable).Key])
+	}
+	return timetables, nil
+}
+
+// Save stores the timetable if its revision matches the stored revision.
+func (model *MemoryModel) Save(table interface{}) (DocumentMeta, error) {
+	timetable := table.(*Timetable)
+	data, err := json.Marshal(timetable)
+	if err != nil {
+		return DocumentMeta{}, err
+	}
+	model.mu.Lock()
+	defer model.mu.Unlock()
+	rev, ok := model.revs[timetable.Key]
+	if (ok && timetable.rev != strconv.Itoa(rev)) || (!ok && timetable.rev != "") {
+		return DocumentMeta{}, ErrRevisionConflict
+	}
+	model.docs[timetable.Key] = data
+	model.revs[timetable.Key] = rev + 1
+	timetable.rev = strconv.Itoa(rev + 1)
+	return documentMeta(timetable.Key), nil
+}
+
+// NewMemoryModel creates an empty memory model.
+func NewMemoryModel() *MemoryModel {
+	return &MemoryModel{
+		docs:  make(map[string][]byte),
+		revs:  make(map[string]int),
+		locks: make(map[string]memoryLock),
+	}
+}
+
+// FileModel stores each timetable as a JSON file in a directory.  Files
+// are replaced atomically so a crash leaves either the previous or the
+// new version of a timetable.  Saves and named locks hold a lock file in
+// the directory so that replicas sharing the directory see each other's
+// revisions and locks.
+type FileModel struct {
+	// Dir is the directory holding the timetable files.
+	// mu serializes writes to the directory.
+	Dir string
+	mu  sync.Mutex
+}
+
+// Create creates the timetables directory.
+func (model *FileModel) Create() error {
+	return os.MkdirAll(model.Dir, 0755)
+}
+
+// FetchAll gets all timetables stored in the directory ordered by file
+// name.
+func (model *FileModel) FetchAll() ([]interface{}, error) {
+	names, err := filepath.Glob(filepath.Join(model.Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	docs := make([][]byte, len(names))
+	for i, name := range names {
+		if docs[i], err = os.ReadFile(name); err != nil {
+			return nil, err
+		}
+	}
+	return decodeTimetables(names, docs), nil
+}
+
+// Fetch gets the timetable with the provided key from its file.
+func (model *FileModel) Fetch(key string) (interface{}, error) {
+	data, err := os.ReadFile(model.path(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	t := new(Timetable)
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Save writes the timetable to its file, replacing any previous version,
+// if its revision matches the stored revision.  Each write stores the
+// next revision of the timetable.
+func (model *FileModel) Save(table interface{}) (DocumentMeta, error) {
+	timetable := table.(*Timetable)
+	model.mu.Lock()
+	defer model.mu.Unlock()
+	lock, err := model.lock()
+	if err != nil {
+		return DocumentMeta{}, err
+	}
+	defer lock.Close()
+	stored, err := model.rev(timetable.Key)
+	if err != nil {
+		return DocumentMeta{}, err
+	}
+	if rev := strconv.Itoa(stored); (stored > 0 && timetable.rev != rev) || (stored == 0 && timetable.rev != "") {
+		return DocumentMeta{}, ErrRevisionConflict
+	}
+	doc := timetable.document()
+	doc.Rev = strconv.Itoa(stored + 1)
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return DocumentMeta{}, err
+	}
+	if err := model.write(model.path(timetable.Key), data); err != nil {
+		return DocumentMeta{}, err
+	}
+	timetable.rev = doc.Rev
+	return documentMeta(timetable.Key), nil
+}
+
+// fileLock is a named lock stored by the file model.
+type fileLock struct {
+	Owner     string    `json:"owner"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// AcquireLock takes or renews the named lock for the owner.  The lock is
+// kept in a file of the directory until it is released or expires.
+func (model *FileModel) AcquireLock(name string, owner string, ttl time.Duration) (bool, error) {
+	model.mu.Lock()
+	defer model.mu.Unlock()
+	f, err := model.lock()
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	lock, err := model.readLock(name)
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	if lock != nil && lock.Owner != owner && now.Before(lock.ExpiresAt) {
+		return false, nil
+	}
+	data, err := json.Marshal(&fileLock{Owner: owner, ExpiresAt: now.Add(ttl)})
+	if err != nil {
+		return false, err
+	}
+	if err := model.write(model.lockPath(name), data); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ReleaseLock deletes the named lock file if the owner holds the lock.
+func (model *FileModel) ReleaseLock(name string, owner string) error {
+	model.mu.Lock()
+	defer model.mu.Unlock()
+	f, err := model.lock()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	lock, err := model.readLock(name)
+	if err != nil || lock == nil || lock.Owner != owner {
+		return err
+	}
+	if err := os.Remove(model.lockPath(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// readLock reads the named lock.  A nil lock is returned if the lock is
+// not held.
+func (model *FileModel) readLock(name string) (*fileLock, error) {
+	data, err := os.ReadFile(model.lockPath(name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	lock := new(fileLock)
+	if err := json.Unmarshal(data, lock); err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+// write replaces the file at path with the data through a temporary file
+// renamed over it.
+func (model *FileModel) write(path string, data []byte) error {
+	f, err := os.CreateTemp(model.Dir, ".timetable-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// lock opens the lock file of the directory and locks it.  The lock is
+// released when the returned file is closed.
+func (model *FileModel) lock() (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(model.Dir, ".lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// rev returns the revision of the stored timetable with the provided
+// key.  Timetables that are not stored and files written before
+// revisions were kept have revision 0.
+func (model *FileModel) rev(key string) (int, error) {
+	data, err := os.ReadFile(model.path(key))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	var doc struct {
+		Rev string `json:"_rev"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return 0, err
+	}
+	if doc.Rev == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(doc.Rev)
+}
+
+// path returns the path of the file holding the timetable with the
+// provided key.  The key is escaped so that any key maps to a single
+// file in the directory.
+func (model *FileModel) path(key string) string {
+	return filepath.Join(model.Dir, escapeFileName(key)+".json")
+}
+
+// lockPath returns the path of the file holding the named lock.  Lock
+// files have no extension so they are not listed as timetables.
+func (model *FileModel) lockPath(name string) string {
+	return filepath.Join(model.Dir, ".lock-"+escapeFileName(name))
+}
+
+// escapeFileName escapes the name so that any name maps to a single
+// file name.
+func escapeFileName(name string) string {
+	return strings.ReplaceAll(url.PathEscape(name), ".", "%2E")
+}
+
+// NewFileModel creates a file model storing the timetables in the
+// directory.
+func NewFileModel(dir string) *FileModel {
+	return &FileModel{Dir: dir}
+}
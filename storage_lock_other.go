@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// lockFile is a no-op on platforms without flock, so saves are only
+// serialized within a process.
+func lockFile(f *os.File) error {
+	return nil
+}
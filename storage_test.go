@@ -0,0 +1,348 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testModelConformance runs the behavior every Model implementation must
+// share.  open returns the model under test, reopening the same storage
+// when called again.
+func testModelConformance(t *testing.T, open func() Model) {
+	prefix := fmt.Sprintf("conformance-%d-", time.Now().UnixNano())
+	fetch := func(model Model) map[string]*Timetable {
+		timetables, err := model.FetchAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := make(map[string]*Timetable)
+		for _, v := range timetables {
+			timetable := v.(*Timetable)
+			if len(timetable.Key) >= len(prefix) && timetable.Key[:len(prefix)] == prefix {
+				found[timetable.Key] = timetable
+			}
+		}
+		return found
+	}
+
+	model := open()
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	if err := model.Create(); err != nil {
+		t.Fatalf("expected create to be idempotent, got %s", err)
+	}
+	if found := fetch(model); len(found) != 0 {
+		t.Fatalf("expected no timetables, got %d", len(found))
+	}
+
+	runAt := time.Now().UTC().Format(time.RFC3339)
+	first := NewTimetable(prefix + "first")
+	first.Exclusive = true
+	first.TimeZone = "Europe/Berlin"
+	first.Order = OrderPriority
+	first.Insert(&Task{Id: "a", RunAt: runAt, Payload: []byte(`{"n":1}`), Labels: map[string]string{"team": "mail"}, Priority: 3})
+	first.Insert(&Task{Id: "b", RunAt: time.Now().Add(time.Minute).UTC().Format(time.RFC3339), Cron: "@hourly"})
+	meta, err := model.Save(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Id == "" {
+		t.Fatal("expected document id")
+	}
+	second := NewTimetable(prefix + "second")
+	if _, err := model.Save(second); err != nil {
+		t.Fatal(err)
+	}
+
+	// saving again replaces the stored timetable.
+	first.Remove("b")
+	if _, err := first.Claim("w1", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := model.Save(first); err != nil {
+		t.Fatal(err)
+	}
+
+	found := fetch(open())
+	if len(found) != 2 {
+		t.Fatalf("expected 2 timetables, got %d", len(found))
+	}
+	stored, ok := found[first.Key]
+	if !ok {
+		t.Fatalf("expected timetable %s", first.Key)
+	}
+	if !stored.Exclusive || stored.TimeZone != "Europe/Berlin" || stored.Order != OrderPriority {
+		t.Fatal("expected timetable settings to be stored")
+	}
+	if len(stored.List()) != 0 {
+		t.Fatal("expected the saved schedule to replace the previous one")
+	}
+	leases := stored.Leases()
+	if len(leases) != 1 || leases[0].Task.Id != "a" || string(leases[0].Task.Payload) != `{"n":1}` || leases[0].Task.Labels["team"] != "mail" || leases[0].Task.Priority != 3 {
+		t.Fatal("expected the claimed task to be stored")
+	}
+	if _, ok := found[second.Key]; !ok {
+		t.Fatalf("expected timetable %s", second.Key)
+	}
+
+	v, err := open().Fetch(first.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetched, ok := v.(*Timetable); !ok || fetched.Key != first.Key || len(fetched.Leases()) != 1 {
+		t.Fatalf("expected fetch to return timetable %s", first.Key)
+	}
+	if v, err := open().Fetch(prefix + "missing"); err != nil || v != nil {
+		t.Fatalf("expected nil for a missing timetable, got %v, %v", v, err)
+	}
+}
+
+// testRevisionConformance runs the behavior every Model implementation
+// that checks revisions must share.
+func testRevisionConformance(t *testing.T, model Model) {
+	key := fmt.Sprintf("revisions-%d", time.Now().UnixNano())
+	runAt := time.Now().UTC().Format(time.RFC3339)
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	fetch := func() *Timetable {
+		v, err := model.Fetch(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v.(*Timetable)
+	}
+
+	a := NewTimetable(key)
+	if _, err := model.Save(a); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := model.Save(NewTimetable(key)); err != ErrRevisionConflict {
+		t.Fatalf("expected creating an existing timetable to conflict, got %v", err)
+	}
+	b := fetch()
+	a.Insert(&Task{Id: "x", RunAt: runAt})
+	if _, err := model.Save(a); err != nil {
+		t.Fatal(err)
+	}
+	b.Insert(&Task{Id: "y", RunAt: runAt})
+	if _, err := model.Save(b); err != ErrRevisionConflict {
+		t.Fatalf("expected saving a stale timetable to conflict, got %v", err)
+	}
+
+	b = fetch()
+	b.Insert(&Task{Id: "y", RunAt: runAt})
+	if _, err := model.Save(b); err != nil {
+		t.Fatal(err)
+	}
+	if tasks := fetch().List(); len(tasks) != 2 || tasks[0].Id != "x" || tasks[1].Id != "y" {
+		t.Fatal("expected tasks x and y to be stored")
+	}
+
+	if tasks, ok := model.(TaskModel); ok {
+		if _, err := tasks.InsertTask(key, fetch().rev, &Task{Id: "z", RunAt: runAt}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tasks.RemoveTask(key, b.rev, "z"); err != ErrRevisionConflict {
+			t.Fatalf("expected a stale task write to conflict, got %v", err)
+		}
+		if _, err := model.Save(b); err != ErrRevisionConflict {
+			t.Fatalf("expected saving over a task write to conflict, got %v", err)
+		}
+
+		// a task write hands its revision to the timetable.
+		b = fetch()
+		b.Insert(&Task{Id: "w", RunAt: runAt})
+		if err := b.SaveTasks(model, "w"); err != nil {
+			t.Fatal(err)
+		}
+		b.Exclusive = true
+		if _, err := model.Save(b); err != nil {
+			t.Fatalf("expected saving after a task write to succeed, got %v", err)
+		}
+	}
+}
+
+// testTaskModelConformance runs the behavior every TaskModel
+// implementation must share.
+func testTaskModelConformance(t *testing.T, model Model) {
+	tasks := model.(TaskModel)
+	key := fmt.Sprintf("tasks-%d", time.Now().UnixNano())
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	fetch := func() *Timetable {
+		timetables, err := model.FetchAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range timetables {
+			if timetable := v.(*Timetable); timetable.Key == key {
+				return timetable
+			}
+		}
+		t.Fatalf("expected timetable %s", key)
+		return nil
+	}
+
+	now := time.Now()
+	a := &Task{Id: "a", RunAt: now.Add(-time.Minute).UTC().Format(time.RFC3339), Payload: []byte(`{"n":1}`)}
+	b := &Task{Id: "b", RunAt: now.Add(time.Minute).UTC().Format(time.RFC3339)}
+	rev, err := tasks.InsertTask(key, "", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tasks.InsertTask(key, "", b); err != ErrRevisionConflict {
+		t.Fatalf("expected creating an existing timetable to conflict, got %v", err)
+	}
+	if rev, err = tasks.InsertTask(key, rev, b); err != nil {
+		t.Fatal(err)
+	}
+	lease := &Lease{Task: a, WorkerId: "w1", Token: "abc", ExpiresAt: now.Add(time.Minute)}
+	if rev, err = tasks.ClaimTask(key, rev, lease); err != nil {
+		t.Fatal(err)
+	}
+	timetable := fetch()
+	if timetable.rev != rev {
+		t.Fatalf("expected revision %s, got %s", rev, timetable.rev)
+	}
+	if scheduled := timetable.List(); len(scheduled) != 1 || scheduled[0].Id != "b" {
+		t.Fatal("expected only task b to be scheduled")
+	}
+	leases := timetable.Leases()
+	if len(leases) != 1 || leases[0].Token != "abc" || string(leases[0].Task.Payload) != `{"n":1}` {
+		t.Fatal("expected task a to be claimed")
+	}
+
+	// inserting a claimed task returns it to the schedule.
+	if rev, err = tasks.InsertTask(key, rev, a); err != nil {
+		t.Fatal(err)
+	}
+	stale := rev
+	if rev, err = tasks.RemoveTask(key, rev, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if rev, err = tasks.RemoveTask(key, rev, "missing"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tasks.ClaimTask(key, stale, lease); err != ErrRevisionConflict {
+		t.Fatalf("expected a stale claim to conflict, got %v", err)
+	}
+	timetable = fetch()
+	if scheduled := timetable.List(); len(scheduled) != 1 || scheduled[0].Id != "a" || len(timetable.Leases()) != 0 {
+		t.Fatal("expected only task a to be scheduled")
+	}
+}
+
+func TestMemoryModelConformance(t *testing.T) {
+	model := NewMemoryModel()
+	testModelConformance(t, func() Model { return model })
+	testRevisionConformance(t, model)
+}
+
+func TestFileModelConformance(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "timetables")
+	testModelConformance(t, func() Model { return NewFileModel(dir) })
+	testRevisionConformance(t, NewFileModel(dir))
+}
+
+func TestTimetableModelConformance(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+	testModelConformance(t, func() Model { return new(TimetableModel) })
+	testTaskModelConformance(t, new(TimetableModel))
+	testRevisionConformance(t, new(TimetableModel))
+}
+
+func TestFileModelRevision(t *testing.T) {
+	model := NewFileModel(t.TempDir())
+	timetable := NewTimetable("k")
+	for _, rev := range []string{"1", "2"} {
+		if _, err := model.Save(timetable); err != nil {
+			t.Fatal(err)
+		}
+		if timetable.rev != rev {
+			t.Fatalf("expected revision %s, got %q", rev, timetable.rev)
+		}
+	}
+	v, err := model.Fetch("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.(*Timetable).rev != "2" {
+		t.Fatalf("expected the stored revision 2, got %q", v.(*Timetable).rev)
+	}
+}
+
+func TestFileModelKeys(t *testing.T) {
+	model := NewFileModel(t.TempDir())
+	keys := []string{`a/b`, `a%2Fb`, `..`, `"quoted".json`, `ünïcode`}
+	for _, key := range keys {
+		if _, err := model.Save(NewTimetable(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	timetables, err := model.FetchAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]bool)
+	for _, v := range timetables {
+		found[v.(*Timetable).Key] = true
+	}
+	for _, key := range keys {
+		if !found[key] {
+			t.Fatalf("expected timetable %q to be stored in its own file", key)
+		}
+	}
+}
+
+func TestFileModelMalformed(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "broken.json"), []byte(`{"_key":`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	legacy := `{"_key": "legacy", "schedule": [{"_key": "abc123", "runAt": "2017-05-01 10:30:00.123456789 +0000 UTC m=+0.001"}]}`
+	if err := os.WriteFile(filepath.Join(dir, "legacy.json"), []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	model := NewFileModel(dir)
+	timetables, err := model.FetchAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(timetables) != 1 || timetables[0].(*Timetable).Key != "legacy" {
+		t.Fatal("expected the malformed timetable to be skipped")
+	}
+	if tasks := timetables[0].(*Timetable).List(); len(tasks) != 1 || tasks[0].RunAt != "2017-05-01T10:30:00.123456789Z" {
+		t.Fatal("expected the legacy run at time to be loaded")
+	}
+	if _, err := model.Fetch("broken"); err == nil {
+		t.Fatal("expected decode error")
+	}
+}
+
+func TestNewModel(t *testing.T) {
+	if model, err := NewModel(StorageMemory, ""); err != nil {
+		t.Fatal(err)
+	} else if _, ok := model.(*MemoryModel); !ok {
+		t.Fatal("expected memory model")
+	}
+	dir := filepath.Join(t.TempDir(), "data")
+	if model, err := NewModel(StorageFile, dir); err != nil {
+		t.Fatal(err)
+	} else if _, ok := model.(*FileModel); !ok {
+		t.Fatal("expected file model")
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Fatal("expected storage directory to be created")
+	}
+	if _, err := NewModel("tape", ""); err == nil {
+		t.Fatal("expected unknown storage backend error")
+	}
+}
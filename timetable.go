@@ -2,105 +2,612 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"fmt"
+	"log"
 	"sort"
+	"sync"
 	"time"
 )
 
+const (
+	OrderTime     = "time"     // due tasks are handed out in run at time order.
+	OrderPriority = "priority" // the highest priority due task is handed out first.
+)
+
+// ErrEmptySchedule is returned when the timetable has no scheduled tasks.
+var ErrEmptySchedule = errors.New("empty schedule")
+
+// ErrDuplicateTask is returned when a task id is already in use in the
+// timetable.
+var ErrDuplicateTask = errors.New("task id conflict")
+
+// ErrTaskNotFound is returned when no task with the id is in the
+// timetable.
+var ErrTaskNotFound = errors.New("task not found")
+
+// ErrScheduleConflict is returned when an exclusive timetable already has
+// a task scheduled at the run at time.
+var ErrScheduleConflict = errors.New("schedule conflict")
+
+// ErrInvalidLeaseToken is returned when the lease token does not match
+// the token handed out for the claimed task.
+var ErrInvalidLeaseToken = errors.New("invalid lease token")
+
 // Task is a unit of work that is scheduled in the timetable.
 type Task struct {
 	// Id is the unique version 1 uuid assigned for task identification.
 	// RunAt is the point in time to schedule for execution.
-	Id    string `json:"_key"`
-	RunAt string `json:"runAt"`
+	// Cron is the optional cron expression of a recurring task.
+	// RRule is the optional RFC 5545 recurrence rule of a recurring task.
+	// Start is the start of the recurrence rule series.
+	// TimeZone is the IANA time zone the recurrence is evaluated in.
+	// Callback is the optional request sent when the task comes due.
+	// Delivery is the outcome of the last callback delivery.
+	// Payload is the optional JSON document handed to the worker.
+	// Labels are the optional string metadata of the task.
+	// Priority ranks due tasks in timetables ordered by priority, higher
+	// priorities are handed out first.
+	Id       string            `json:"_key"`
+	RunAt    string            `json:"runAt"`
+	Cron     string            `json:"cron,omitempty"`
+	RRule    string            `json:"rrule,omitempty"`
+	Start    string            `json:"start,omitempty"`
+	TimeZone string            `json:"timeZone,omitempty"`
+	Callback *Callback         `json:"callback,omitempty"`
+	Delivery *Delivery         `json:"delivery,omitempty"`
+	Payload  json.RawMessage   `json:"payload,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Priority int               `json:"priority,omitempty"`
+}
+
+// view returns a copy of the task handed to clients with its callback
+// headers redacted.
+func (task *Task) view() *Task {
+	clone := *task
+	clone.Callback = task.Callback.redact()
+	return &clone
+}
+
+// Identical reports whether the task has the same id, run at time and
+// payload as the other task.
+func (task *Task) Identical(other *Task) bool {
+	if task.Id != other.Id {
+		return false
+	}
+	at, err := time.Parse(time.RFC3339, task.RunAt)
+	if err != nil {
+		return false
+	}
+	otherAt, err := time.Parse(time.RFC3339, other.RunAt)
+	if err != nil || !at.Equal(otherAt) {
+		return false
+	}
+	var payload, otherPayload bytes.Buffer
+	if len(task.Payload) > 0 {
+		if err := json.Compact(&payload, task.Payload); err != nil {
+			return false
+		}
+	}
+	if len(other.Payload) > 0 {
+		if err := json.Compact(&otherPayload, other.Payload); err != nil {
+			return false
+		}
+	}
+	return bytes.Equal(payload.Bytes(), otherPayload.Bytes())
+}
+
+// Lease is a claim held by a worker on a due task.  The task is handed
+// out again once the lease expires without being acknowledged.
+type Lease struct {
+	// Task is the claimed task.
+	// WorkerId identifies the worker holding the lease.
+	// Token is the secret the worker presents to ack or nack the task.
+	// ExpiresAt is the point in time the lease lapses.
+	Task      *Task     `json:"task"`
+	WorkerId  string    `json:"workerId"`
+	Token     string    `json:"token,omitempty"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Expired reports whether the lease has lapsed at the provided time.
+func (lease *Lease) Expired(now time.Time) bool {
+	return !now.Before(lease.ExpiresAt)
 }
 
-// Timetable keeps track of scheduled tasks for a given resource.
+// Timetable keeps track of scheduled tasks for a given resource.  A
+// timetable is not safe for concurrent use on its own; callers sharing
+// one must hold mu while reading or changing the schedule.
 type Timetable struct {
 	// Key is the task resource key.
-	// schedule holds the tasks keyed on their run at times.
-	Key      string
-	schedule map[string]*Task
+	// Exclusive reserves each run at time for a single task.
+	// TimeZone is the default IANA time zone of the timetable tasks.
+	// Callback is the default callback of the timetable tasks.
+	// Order is the order due tasks are handed out in, time order if
+	// empty.
+	// schedule holds the tasks ordered by run at time.
+	// leases holds the claimed tasks keyed on their ids.
+	// deliveries holds the most recent finished callback deliveries.
+	// rev is the database revision the timetable was last fetched or
+	// saved at, empty if it has not been stored.
+	// changes is closed and replaced when a task is added to or removed
+	// from the schedule.
+	// mu guards the schedule for callers that share the timetable.
+	Key        string
+	Exclusive  bool
+	TimeZone   string
+	Callback   *Callback
+	Order      string
+	schedule   *taskHeap
+	leases     map[string]*Lease
+	deliveries []*Delivery
+	rev        string
+	changes    chan struct{}
+	mu         sync.RWMutex
 }
 
-// Delay returns the time delay in minutes until the next scheduled task.
-func (table *Timetable) Delay() (int, error) {
-	if len(table.schedule) == 0 {
-		return 0, errors.New("empty schedule")
+// Changes returns a channel that is closed the next time a task is added
+// to or removed from the schedule.  The caller must hold the write lock.
+func (table *Timetable) Changes() <-chan struct{} {
+	if table.changes == nil {
+		table.changes = make(chan struct{})
+	}
+	return table.changes
+}
+
+// notify wakes the callers waiting on Changes.
+func (table *Timetable) notify() {
+	if table.changes != nil {
+		close(table.changes)
+		table.changes = nil
 	}
+}
 
-	tasks := make([]string, 0)
-	for runAt := range table.schedule {
-		tasks = append(tasks, runAt)
+// Ack completes the claimed task with the matching id.  The lease token
+// must match the token handed out by Claim.  The next occurrence of a
+// recurring task is scheduled once it is completed.
+func (table *Timetable) Ack(id string, token string) (*Lease, error) {
+	lease, err := table.lease(id, token)
+	if err != nil {
+		return nil, err
+	}
+	delete(table.leases, id)
+	if err := table.recur(lease.Task, time.Now()); err != nil {
+		table.leases[id] = lease
+		return nil, err
 	}
-	sort.Strings(tasks)
+	return lease, nil
+}
 
-	t, err := time.Parse(time.RFC3339, tasks[0])
+// Claim leases the next due task to the worker for the provided
+// duration.  Tasks whose leases have expired are handed out again in
+// the order of the timetable, ahead of due tasks that rank the same.  A
+// nil lease is returned if no task is due.
+func (table *Timetable) Claim(workerId string, ttl time.Duration) (*Lease, error) {
+	lease, _, err := table.claim(workerId, ttl)
+	return lease, err
+}
+
+// claim leases the next due task like Claim and also returns the expired
+// lease it took over, if any, so that the claim can be undone.
+func (table *Timetable) claim(workerId string, ttl time.Duration) (*Lease, *Lease, error) {
+	now := time.Now()
+	token, err := newLeaseToken()
 	if err != nil {
-		return 0, err
+		return nil, nil, err
+	}
+	var expired *Lease
+	var at time.Time
+	for _, lease := range table.leases {
+		if !lease.Expired(now) {
+			continue
+		}
+		t, _ := time.Parse(time.RFC3339, lease.Task.RunAt)
+		if expired == nil || table.ranksBefore(lease.Task, t, expired.Task, at) {
+			expired, at = lease, t
+		}
+	}
+	var task *Task
+	var prev *Lease
+	if item := table.first(now); item != nil && (expired == nil || table.ranksBefore(item.task, item.at, expired.Task, at)) {
+		table.schedule.remove(item.task.Id)
+		task = item.task
+	} else if expired != nil {
+		task, prev = expired.Task, expired
+	} else {
+		return nil, nil, nil
+	}
+	lease := &Lease{
+		Task:      task,
+		WorkerId:  workerId,
+		Token:     token,
+		ExpiresAt: now.Add(ttl),
+	}
+	table.leases[task.Id] = lease
+	return lease, prev, nil
+}
+
+// unclaim undoes a lease made by claim or dispatch.  The expired lease
+// it took over is put back, otherwise the task is returned to the
+// schedule.
+func (table *Timetable) unclaim(lease *Lease, prev *Lease) {
+	delete(table.leases, lease.Task.Id)
+	if prev != nil {
+		table.leases[prev.Task.Id] = prev
+		return
+	}
+	table.restore(lease.Task)
+}
+
+// Deliveries returns the most recent finished callback deliveries, oldest
+// first.
+func (table *Timetable) Deliveries() []*Delivery {
+	deliveries := make([]*Delivery, len(table.deliveries))
+	copy(deliveries, table.deliveries)
+	return deliveries
+}
+
+// Dispatch leases the due tasks that have a callback to the worker for
+// the provided duration.  Expired leases held by the worker are renewed
+// so that their deliveries are sent again.
+func (table *Timetable) Dispatch(workerId string, ttl time.Duration) ([]*Lease, error) {
+	leases, _, err := table.dispatch(workerId, ttl)
+	return leases, err
+}
+
+// dispatch leases the due tasks like Dispatch and also returns the
+// expired lease each lease took over, or nil for a task taken from the
+// schedule, so that each lease can be undone with unclaim.
+func (table *Timetable) dispatch(workerId string, ttl time.Duration) ([]*Lease, []*Lease, error) {
+	now := time.Now()
+	tasks := make([]*Task, 0)
+	prevs := make([]*Lease, 0)
+	for _, lease := range table.leases {
+		if lease.WorkerId == workerId && lease.Expired(now) {
+			tasks = append(tasks, lease.Task)
+			prevs = append(prevs, lease)
+		}
+	}
+	removed := false
+	for _, item := range table.schedule.due(now) {
+		if table.callback(item.task) == nil {
+			continue
+		}
+		table.schedule.remove(item.task.Id)
+		tasks = append(tasks, item.task)
+		prevs = append(prevs, nil)
+		removed = true
+	}
+	if removed {
+		table.notify()
+	}
+	leases := make([]*Lease, 0, len(tasks))
+	for i, task := range tasks {
+		token, err := newLeaseToken()
+		if err != nil {
+			// the tasks that were not leased go back to the schedule.
+			for j := i; j < len(tasks); j++ {
+				if prevs[j] == nil {
+					table.restore(tasks[j])
+				}
+			}
+			return leases, prevs[:i], err
+		}
+		lease := &Lease{
+			Task:      task,
+			WorkerId:  workerId,
+			Token:     token,
+			ExpiresAt: now.Add(ttl),
+		}
+		table.leases[task.Id] = lease
+		leases = append(leases, lease)
+	}
+	return leases, prevs, nil
+}
+
+// Leases returns all claimed tasks ordered by task id.
+func (table *Timetable) Leases() []*Lease {
+	leases := make([]*Lease, 0, len(table.leases))
+	for _, lease := range table.leases {
+		leases = append(leases, lease)
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		return leases[i].Task.Id < leases[j].Task.Id
+	})
+	return leases
+}
+
+// Nack gives up the claimed task with the matching id and schedules it
+// to run again at the retry time.  The original run at time is kept if
+// retry at is empty.
+func (table *Timetable) Nack(id string, token string, retryAt string) (*Lease, error) {
+	lease, err := table.lease(id, token)
+	if err != nil {
+		return nil, err
+	}
+	task := *lease.Task
+	if retryAt != "" {
+		task.RunAt = retryAt
+	}
+	delete(table.leases, id)
+	if err := table.Insert(&task); err != nil {
+		table.leases[id] = lease
+		return nil, err
+	}
+	return lease, nil
+}
+
+// Preview returns the next n run at times of the scheduled or claimed
+// task with the matching id.
+func (table *Timetable) Preview(id string, n int) ([]string, error) {
+	task, ok := table.schedule.get(id)
+	if !ok {
+		lease, ok := table.leases[id]
+		if !ok {
+			return nil, ErrTaskNotFound
+		}
+		task = lease.Task
+	}
+	return task.Preview(n)
+}
+
+// Record adds the finished delivery to the delivery history.  Only the
+// most recent MaxDeliveryHistory deliveries are kept.
+func (table *Timetable) Record(delivery *Delivery) {
+	table.deliveries = append(table.deliveries, delivery)
+	if n := len(table.deliveries) - MaxDeliveryHistory; n > 0 {
+		table.deliveries = append(table.deliveries[:0:0], table.deliveries[n:]...)
+	}
+}
+
+// Release expires the lease on the claimed task with the matching id so
+// that it can be claimed again immediately.
+func (table *Timetable) Release(id string) {
+	if lease, ok := table.leases[id]; ok {
+		lease.ExpiresAt = time.Time{}
+	}
+}
+
+// callback returns the callback of the task, falling back to the
+// timetable callback.
+func (table *Timetable) callback(task *Task) *Callback {
+	if task.Callback != nil {
+		return task.Callback
+	}
+	return table.Callback
+}
+
+// lease returns the lease for the task id if the token matches.
+func (table *Timetable) lease(id string, token string) (*Lease, error) {
+	lease, ok := table.leases[id]
+	if !ok {
+		return nil, ErrTaskNotFound
+	}
+	if lease.Token != token {
+		return nil, ErrInvalidLeaseToken
+	}
+	return lease, nil
+}
+
+// restoreLease puts back a lease given up by Ack or Nack.
+func (table *Timetable) restoreLease(lease *Lease) {
+	table.Remove(lease.Task.Id)
+	table.leases[lease.Task.Id] = lease
+}
+
+// Delay returns the time delay in minutes until the next scheduled task.
+// The delay is truncated to whole minutes and one minute is added while
+// the task is not yet due, as earlier versions did.  Due reports the
+// precise delay.  ErrEmptySchedule is returned if there are no scheduled
+// tasks.
+func (table *Timetable) Delay() (int, error) {
+	return table.delay(time.Now())
+}
+
+// delay returns the delay of the next scheduled task at the provided
+// time, rounded as described by Delay.
+func (table *Timetable) delay(now time.Time) (int, error) {
+	head := table.schedule.peek()
+	if head == nil {
+		return 0, ErrEmptySchedule
 	}
-	delay := int(t.Sub(time.Now()).Minutes())
+
+	delay := int(head.at.Sub(now).Minutes())
 	if delay > 0 {
 		delay++
 	}
 	return delay, nil
 }
 
-// Insert adds the task to the schedule if the run at time is
-// not already reserved.
+// Insert adds the task to the schedule if the task id is not already
+// in use.  Exclusive timetables also reject a task whose run at time
+// is already reserved.
 func (table *Timetable) Insert(task *Task) error {
-	if _, ok := table.schedule[task.RunAt]; ok {
-		return errors.New("schedule conflict")
+	at, err := time.Parse(time.RFC3339, task.RunAt)
+	if err != nil {
+		return err
+	}
+	if _, ok := table.Lookup(task.Id); ok {
+		return ErrDuplicateTask
 	}
-	table.schedule[task.RunAt] = task
+	if table.Exclusive && table.schedule.reserved(at) {
+		return ErrScheduleConflict
+	}
+	table.schedule.add(task, at)
+	table.notify()
 	return nil
 }
 
-// List returns all items in the schedule.
-func (table *Timetable) List() []*Task {
-	tasks := make([]*Task, 0)
-	for _, task := range table.schedule {
-		tasks = append(tasks, task)
+// Lookup returns the scheduled or claimed task with the matching id.
+func (table *Timetable) Lookup(id string) (*Task, bool) {
+	if task, ok := table.schedule.get(id); ok {
+		return task, true
 	}
-	return tasks
+	if lease, ok := table.leases[id]; ok {
+		return lease.Task, true
+	}
+	return nil, false
+}
+
+// List returns all items in the schedule in the order they run.
+func (table *Timetable) List() []*Task {
+	return table.schedule.sorted()
 }
 
-// Next returns the next task in the schedule
+// Next returns the next task in the schedule if it is due.  The next
+// occurrence of a recurring task is scheduled in its place.
 func (table *Timetable) Next() *Task {
-	if len(table.schedule) < 1 {
+	now := time.Now()
+	task := table.pop(now)
+	if task == nil {
 		return nil
 	}
-	var next *time.Time
-	var task *Task
-	for k := range table.schedule {
-		t, _ := time.Parse(time.RFC3339, k)
-		if next == nil {
-			next = &t
-			continue
+	if err := table.recur(task, now); err != nil {
+		table.restore(task)
+		return nil
+	}
+	return task
+}
+
+// NextRunAt returns the run at time of the first task in the schedule.
+// False is returned if the schedule is empty.
+func (table *Timetable) NextRunAt() (time.Time, bool) {
+	head := table.schedule.peek()
+	if head == nil {
+		return time.Time{}, false
+	}
+	return head.at, true
+}
+
+// Remove deletes the task with the matching id from the timetable.
+func (table *Timetable) Remove(id string) error {
+	if _, ok := table.schedule.remove(id); !ok {
+		return ErrTaskNotFound
+	}
+	table.notify()
+	return nil
+}
+
+// Reschedule moves the scheduled task with the matching id to the run at
+// time and replaces its payload if one is provided.  Exclusive timetables
+// reject a run at time reserved by another task.  The moved task runs
+// after the tasks already sharing its run at time.  The task as it was
+// before the move is returned.
+func (table *Timetable) Reschedule(id string, runAt string, payload json.RawMessage) (*Task, error) {
+	at, err := time.Parse(time.RFC3339, runAt)
+	if err != nil {
+		return nil, err
+	}
+	item, ok := table.schedule.ids[id]
+	if !ok {
+		return nil, ErrTaskNotFound
+	}
+	if table.Exclusive && !at.Equal(item.at) && table.schedule.reserved(at) {
+		return nil, ErrScheduleConflict
+	}
+	task := *item.task
+	task.RunAt = runAt
+	if payload != nil {
+		task.Payload = payload
+	}
+	table.schedule.remove(id)
+	table.schedule.add(&task, at)
+	table.notify()
+	return item.task, nil
+}
+
+// pop removes and returns the first due task in the schedule.  The
+// first task is the earliest one unless the timetable is ordered by
+// priority.
+func (table *Timetable) pop(now time.Time) *Task {
+	first := table.first(now)
+	if first == nil {
+		return nil
+	}
+	table.schedule.remove(first.task.Id)
+	return first.task
+}
+
+// first returns the first due item in the schedule without removing it,
+// as chosen by pop.  Nil is returned if no task is due.
+func (table *Timetable) first(now time.Time) *scheduleItem {
+	if table.Order != OrderPriority {
+		head := table.schedule.peek()
+		if head == nil || !now.After(head.at) {
+			return nil
 		}
-		if t.Before(*next) {
-			next = &t
+		return head
+	}
+	var first *scheduleItem
+	for _, item := range table.schedule.due(now) {
+		if first == nil || item.task.Priority > first.task.Priority ||
+			(item.task.Priority == first.task.Priority && item.runsBefore(first)) {
+			first = item
 		}
 	}
-	if time.Now().After(*next) {
-		task = table.schedule[next.Format(time.RFC3339)]
-		delete(table.schedule, next.Format(time.RFC3339))
+	return first
+}
+
+// ranksBefore reports whether the task running at the provided time is
+// handed out ahead of the other task.
+func (table *Timetable) ranksBefore(task *Task, at time.Time, other *Task, otherAt time.Time) bool {
+	if table.Order == OrderPriority && task.Priority != other.Priority {
+		return task.Priority > other.Priority
 	}
-	return task
+	return at.Before(otherAt)
 }
 
-// Remove deletes the task with the matching run at time from
-// the timetable.
-func (table *Timetable) Remove(id string) error {
-	for k, task := range table.schedule {
-		if task.Id == id {
-			delete(table.schedule, k)
+// recur schedules the first occurrence of the recurring task after the
+// provided time.  Occurrences that conflict with a reserved run at time
+// in an exclusive timetable are skipped.
+func (table *Timetable) recur(task *Task, after time.Time) error {
+	recurrence, err := task.Recurrence()
+	if err != nil || recurrence == nil {
+		return err
+	}
+	for {
+		at := recurrence.Next(after)
+		if at.IsZero() {
 			return nil
 		}
+		if table.Exclusive && table.schedule.reserved(at) {
+			after = at
+			continue
+		}
+		next := *task
+		next.RunAt = FormatRunAt(at)
+		table.schedule.add(&next, at)
+		table.notify()
+		return nil
 	}
-	return errors.New("not found")
+}
+
+// replace swaps the settings, schedule, leases and revision of the
+// timetable for those of the other timetable, typically a fresh copy
+// fetched from the database.  The timetable is reset to an empty
+// schedule if other is nil.
+func (table *Timetable) replace(other *Timetable) {
+	if other == nil {
+		other = NewTimetable(table.Key)
+	}
+	table.Exclusive = other.Exclusive
+	table.TimeZone = other.TimeZone
+	table.Callback = other.Callback
+	table.Order = other.Order
+	table.schedule = other.schedule
+	table.leases = other.leases
+	table.deliveries = other.deliveries
+	table.rev = other.rev
+	table.notify()
+}
+
+// restore puts back a task handed out by Next, replacing any occurrence
+// scheduled in its place.
+func (table *Timetable) restore(task *Task) {
+	table.Remove(task.Id)
+	table.Insert(task)
 }
 
 // Save writes the timetable to the database.
@@ -108,50 +615,168 @@ func (table *Timetable) Save(model Model) (DocumentMeta, error) {
 	return model.Save(table)
 }
 
-// MarshalJSON serializes the timetable key and schedule.
+// timetableDocument is the serialized form of a timetable.  The
+// revision is only read.
+type timetableDocument struct {
+	Key        string      `json:"_key"`
+	Rev        string      `json:"_rev,omitempty"`
+	Schedule   []*Task     `json:"schedule"`
+	Exclusive  bool        `json:"exclusive,omitempty"`
+	TimeZone   string      `json:"timeZone,omitempty"`
+	Callback   *Callback   `json:"callback,omitempty"`
+	Order      string      `json:"order,omitempty"`
+	Deliveries []*Delivery `json:"deliveries,omitempty"`
+	Leases     []*Lease    `json:"leases,omitempty"`
+}
+
+// document returns the serialized form of the timetable.  Tasks are
+// listed in the order they run and leases in task id order so that the
+// same timetable always serializes the same way.
+func (table *Timetable) document() *timetableDocument {
+	return &timetableDocument{
+		Key:        table.Key,
+		Schedule:   table.List(),
+		Exclusive:  table.Exclusive,
+		TimeZone:   table.TimeZone,
+		Callback:   table.Callback,
+		Order:      table.Order,
+		Deliveries: table.deliveries,
+		Leases:     table.Leases(),
+	}
+}
+
+// view returns the serialized form of the timetable handed to clients.
+// Lease tokens are left out so that only the worker holding a lease can
+// ack or nack its task, and callback headers are redacted.
+func (table *Timetable) view() *timetableDocument {
+	doc := table.document()
+	doc.Callback = doc.Callback.redact()
+	for i, task := range doc.Schedule {
+		doc.Schedule[i] = task.view()
+	}
+	for i, lease := range doc.Leases {
+		view := *lease
+		view.Token = ""
+		view.Task = lease.Task.view()
+		doc.Leases[i] = &view
+	}
+	return doc
+}
+
+// SaveTasks writes the tasks with the matching ids to the database.
+// Models implementing TaskModel only write the state of those tasks,
+// other models save the whole timetable.  Each write is conditional on
+// the revision of the timetable and the timetable takes the revision of
+// each write.
+func (table *Timetable) SaveTasks(model Model, ids ...string) error {
+	tasks, ok := model.(TaskModel)
+	if !ok {
+		_, err := model.Save(table)
+		return err
+	}
+	for _, id := range ids {
+		var rev string
+		var err error
+		if lease, ok := table.leases[id]; ok {
+			rev, err = tasks.ClaimTask(table.Key, table.rev, lease)
+		} else if task, ok := table.schedule.get(id); ok {
+			rev, err = tasks.InsertTask(table.Key, table.rev, task)
+		} else {
+			rev, err = tasks.RemoveTask(table.Key, table.rev, id)
+		}
+		if err != nil {
+			return err
+		}
+		table.rev = rev
+	}
+	return nil
+}
+
+// MarshalJSON serializes the timetable key, settings, schedule, leases
+// and delivery history.
 func (table *Timetable) MarshalJSON() ([]byte, error) {
-	var buf bytes.Buffer
-	buf.WriteString(
-		fmt.Sprintf(`{"_key": "%s", "schedule": %s}`, table.Key, (func() string {
-			tasks := bytes.NewBuffer([]byte("["))
-			i := 0
-			for _, task := range table.schedule {
-				tasks.WriteString(
-					fmt.Sprintf(`{"_key": "%s", "runAt": "%s"}`, task.Id, task.RunAt),
-				)
-				if i < (len(table.schedule) - 1) {
-					tasks.WriteByte(',')
-				}
-				i++
-			}
-			tasks.WriteString("]")
-			return tasks.String()
-		})(),
-		))
-	return buf.Bytes(), nil
+	return json.Marshal(table.document())
 }
 
 // UnmarshalJSON deserializes the stored timetable meta data into
-// a timetable instance.
+// a timetable instance.  An error is returned if the document is
+// malformed.  Tasks sharing an id are logged and dropped, keeping the
+// claimed task or else the earliest scheduled one.
 func (table *Timetable) UnmarshalJSON(b []byte) error {
-	if table.schedule == nil {
-		table.schedule = make(map[string]*Task)
+	var doc timetableDocument
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return err
+	}
+	if doc.Key == "" {
+		return errors.New("timetable key is required")
+	}
+	schedule := newTaskHeap()
+	for _, task := range doc.Schedule {
+		if task == nil {
+			return errors.New("schedule task is required")
+		}
+		at, err := parseStoredRunAt(task.RunAt)
+		if err != nil {
+			return err
+		}
+		if _, err := time.Parse(time.RFC3339, task.RunAt); err != nil {
+			task.RunAt = FormatRunAt(at)
+		}
+		if item, ok := schedule.ids[task.Id]; ok {
+			if !at.Before(item.at) {
+				log.Printf("timetable %s: dropping duplicate task %s run at %s", doc.Key, task.Id, task.RunAt)
+				continue
+			}
+			schedule.remove(task.Id)
+			log.Printf("timetable %s: dropping duplicate task %s run at %s", doc.Key, task.Id, item.task.RunAt)
+		}
+		schedule.add(task, at)
 	}
-	data := make(map[string]interface{})
-	json.Unmarshal(b, &data)
-	table.Key = data["_key"].(string)
-	for _, task := range data["schedule"].([]interface{}) {
-		v, _ := task.(map[string]interface{})
-		task := &Task{
-			Id:    v["_key"].(string),
-			RunAt: v["runAt"].(string),
+	leases := make(map[string]*Lease)
+	for _, lease := range doc.Leases {
+		if lease == nil || lease.Task == nil {
+			return errors.New("lease task is required")
+		}
+		if _, ok := leases[lease.Task.Id]; ok {
+			log.Printf("timetable %s: dropping duplicate lease of task %s", doc.Key, lease.Task.Id)
+			continue
+		}
+		if item, ok := schedule.remove(lease.Task.Id); ok {
+			log.Printf("timetable %s: dropping duplicate task %s run at %s", doc.Key, lease.Task.Id, item.task.RunAt)
 		}
-		table.schedule[task.RunAt] = task
+		leases[lease.Task.Id] = lease
 	}
+	for _, delivery := range doc.Deliveries {
+		if delivery == nil {
+			return errors.New("delivery is required")
+		}
+	}
+	table.Key = doc.Key
+	table.Exclusive = doc.Exclusive
+	table.TimeZone = doc.TimeZone
+	table.Callback = doc.Callback
+	table.Order = doc.Order
+	table.schedule = schedule
+	table.leases = leases
+	table.deliveries = doc.Deliveries
+	table.rev = doc.Rev
 	return nil
 }
 
 // Newtimetable creates a new Timetable instance.
 func NewTimetable(key string) *Timetable {
-	return &Timetable{key, make(map[string]*Task)}
+	return &Timetable{
+		Key:      key,
+		schedule: newTaskHeap(),
+		leases:   make(map[string]*Lease),
+	}
+}
+
+// newLeaseToken returns a random lease token.
+func newLeaseToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
 }
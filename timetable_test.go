@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"sort"
 	"testing"
 	"time"
 )
@@ -10,21 +11,16 @@ import (
 func TestTimetableDelay(t *testing.T) {
 	timetable := NewTimetable("test")
 	now := time.Now().Add(time.Minute * 5)
-	if _, err := timetable.Delay(); err == nil {
-		t.Fatal("expected empty schedule error")
+	if _, err := timetable.Delay(); err != ErrEmptySchedule {
+		t.Fatalf("expected empty schedule error, got %v", err)
 	}
-	if err := timetable.Insert(&Task{RunAt: "test"}); err != nil {
-		t.Fatal(err)
-	}
-	delay, err := timetable.Delay()
-	if err == nil {
+	if err := timetable.Insert(&Task{Id: "test", RunAt: "test"}); err == nil {
 		t.Fatal("expected time parse error")
 	}
-	timetable.Remove("test")
-	if err := timetable.Insert(&Task{RunAt: now.Format(time.RFC3339)}); err != nil {
+	if err := timetable.Insert(&Task{Id: "now", RunAt: now.Format(time.RFC3339)}); err != nil {
 		t.Fatal(err)
 	}
-	delay, err = timetable.Delay()
+	delay, err := timetable.Delay()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -33,12 +29,40 @@ func TestTimetableDelay(t *testing.T) {
 	}
 }
 
+func TestTimetableDelayRounding(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		offset time.Duration
+		delay  int
+	}{
+		{5 * time.Minute, 6},
+		{5*time.Minute + time.Second, 6},
+		{5*time.Minute - time.Second, 5},
+		{time.Minute, 2},
+		{time.Second, 0},
+		{0, 0},
+		{-30 * time.Second, 0},
+		{-time.Minute, -1},
+		{-time.Minute - time.Second, -1},
+		{-5 * time.Minute, -5},
+	}
+	for _, c := range cases {
+		timetable := NewTimetable("test")
+		if err := timetable.Insert(&Task{Id: "a", RunAt: FormatRunAt(now.Add(c.offset))}); err != nil {
+			t.Fatal(err)
+		}
+		if delay, err := timetable.delay(now); err != nil || delay != c.delay {
+			t.Fatalf("expected a delay of %d minutes at %s, got %d", c.delay, c.offset, delay)
+		}
+	}
+}
+
 func TestTimetableRemove(t *testing.T) {
 	timetable := NewTimetable("test")
 	if err := timetable.Remove("abc123"); err == nil {
 		t.Fatal("expected not found error")
 	}
-	if err := timetable.Insert(&Task{Id: "abc123"}); err != nil {
+	if err := timetable.Insert(&Task{Id: "abc123", RunAt: time.Now().Format(time.RFC3339)}); err != nil {
 		t.Fatal(err)
 	}
 	if err := timetable.Remove("abc123"); err != nil {
@@ -49,28 +73,166 @@ func TestTimetableRemove(t *testing.T) {
 	}
 }
 
+func TestTimetableReschedule(t *testing.T) {
+	now := time.Now()
+	first := now.Add(time.Minute).Format(time.RFC3339)
+	second := now.Add(time.Hour).Format(time.RFC3339)
+	timetable := NewTimetable("test")
+	timetable.Exclusive = true
+	timetable.Insert(&Task{Id: "a", RunAt: first, Payload: []byte(`{"n":1}`)})
+	timetable.Insert(&Task{Id: "b", RunAt: second})
+	if _, err := timetable.Reschedule("missing", first, nil); err != ErrTaskNotFound {
+		t.Fatal("expected not found error")
+	}
+	if _, err := timetable.Reschedule("a", second, nil); err != ErrScheduleConflict {
+		t.Fatal("expected schedule conflict error")
+	}
+	changes := timetable.Changes()
+	prev, err := timetable.Reschedule("b", now.Add(-time.Minute).Format(time.RFC3339), []byte(`{"n":2}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prev.RunAt != second || prev.Payload != nil {
+		t.Fatal("expected the previous task to be returned unchanged")
+	}
+	select {
+	case <-changes:
+	default:
+		t.Fatal("expected reschedule to close the changes channel")
+	}
+	task := timetable.Next()
+	if task == nil || task.Id != "b" || string(task.Payload) != `{"n":2}` {
+		t.Fatal("expected the rescheduled task to be next")
+	}
+	if _, err := timetable.Reschedule("a", first, nil); err != nil {
+		t.Fatalf("expected a task to keep its own run at time, got %s", err)
+	}
+	if tasks := timetable.List(); len(tasks) != 1 || string(tasks[0].Payload) != `{"n":1}` {
+		t.Fatal("expected the payload to be kept")
+	}
+}
+
+func TestTimetableChanges(t *testing.T) {
+	timetable := NewTimetable("test")
+	changes := timetable.Changes()
+	if err := timetable.Insert(&Task{Id: "abc123", RunAt: time.Now().Format(time.RFC3339)}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changes:
+	default:
+		t.Fatal("expected insert to close the changes channel")
+	}
+	changes = timetable.Changes()
+	if err := timetable.Remove("abc123"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changes:
+	default:
+		t.Fatal("expected remove to close the changes channel")
+	}
+	if _, ok := timetable.NextRunAt(); ok {
+		t.Fatal("expected empty schedule")
+	}
+}
+
+func TestTimetableReplace(t *testing.T) {
+	runAt := time.Now().Format(time.RFC3339)
+	timetable := NewTimetable("test")
+	timetable.Insert(&Task{Id: "a", RunAt: runAt})
+	other := NewTimetable("test")
+	other.Exclusive = true
+	other.rev = "2"
+	other.Insert(&Task{Id: "b", RunAt: runAt})
+	changes := timetable.Changes()
+	timetable.replace(other)
+	select {
+	case <-changes:
+	default:
+		t.Fatal("expected replace to close the changes channel")
+	}
+	if tasks := timetable.List(); len(tasks) != 1 || tasks[0].Id != "b" || !timetable.Exclusive || timetable.rev != "2" {
+		t.Fatal("expected the timetable to be replaced")
+	}
+	timetable.replace(nil)
+	if len(timetable.List()) != 0 || timetable.Exclusive || timetable.rev != "" || timetable.Key != "test" {
+		t.Fatal("expected the timetable to be reset")
+	}
+}
+
 func TestTimetableInsert(t *testing.T) {
 	timetable := NewTimetable("test")
 	runAt := time.Now().Format(time.RFC3339)
-	if err := timetable.Insert(&Task{RunAt: runAt}); err != nil {
+	if err := timetable.Insert(&Task{Id: "123", RunAt: runAt}); err != nil {
 		t.Fatal(err)
 	}
-	if err := timetable.Insert(&Task{RunAt: runAt}); err == nil {
-		t.Fatal("expected schedule conflict error")
+	if err := timetable.Insert(&Task{Id: "123", RunAt: runAt}); err != ErrDuplicateTask {
+		t.Fatal("expected task id conflict error")
+	}
+	if err := timetable.Insert(&Task{Id: "321", RunAt: runAt}); err != nil {
+		t.Fatal(err)
 	}
 	if timetable.List()[0].RunAt != runAt {
 		t.Fatal("unexpected task run at time")
 	}
+
+	// claimed task ids stay reserved.
+	if _, err := timetable.Claim("w1", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := timetable.Lookup("123"); !ok {
+		t.Fatal("expected the claimed task to be found")
+	}
+	if err := timetable.Insert(&Task{Id: "123", RunAt: time.Now().Add(time.Hour).Format(time.RFC3339)}); err != ErrDuplicateTask {
+		t.Fatal("expected task id conflict error")
+	}
+}
+
+func TestTaskIdentical(t *testing.T) {
+	task := &Task{Id: "a", RunAt: "2030-01-01T09:00:00Z", Payload: []byte(`{"n": 1, "s": "x"}`)}
+	same := []*Task{
+		{Id: "a", RunAt: "2030-01-01T10:00:00+01:00", Payload: []byte(`{"n":1,"s":"x"}`)},
+		{Id: "a", RunAt: "2030-01-01T09:00:00.000Z", Payload: []byte(`{"n": 1, "s": "x"}`), Priority: 2},
+	}
+	for _, other := range same {
+		if !task.Identical(other) {
+			t.Fatalf("expected %v to be identical", other)
+		}
+	}
+	different := []*Task{
+		{Id: "b", RunAt: "2030-01-01T09:00:00Z", Payload: []byte(`{"n": 1, "s": "x"}`)},
+		{Id: "a", RunAt: "2030-01-01T09:00:01Z", Payload: []byte(`{"n": 1, "s": "x"}`)},
+		{Id: "a", RunAt: "2030-01-01T09:00:00Z", Payload: []byte(`{"n": 2, "s": "x"}`)},
+		{Id: "a", RunAt: "2030-01-01T09:00:00Z"},
+	}
+	for _, other := range different {
+		if task.Identical(other) {
+			t.Fatalf("expected %v to differ", other)
+		}
+	}
+}
+
+func TestTimetableInsertExclusive(t *testing.T) {
+	timetable := NewTimetable("test")
+	timetable.Exclusive = true
+	runAt := time.Now().Format(time.RFC3339)
+	if err := timetable.Insert(&Task{Id: "123", RunAt: runAt}); err != nil {
+		t.Fatal(err)
+	}
+	if err := timetable.Insert(&Task{Id: "321", RunAt: runAt}); err != ErrScheduleConflict {
+		t.Fatal("expected schedule conflict error")
+	}
 }
 
 func TestTimetableList(t *testing.T) {
 	timetable := NewTimetable("test")
 	now := time.Now()
-	if err := timetable.Insert(&Task{RunAt: now.Format(time.RFC3339)}); err != nil {
+	if err := timetable.Insert(&Task{Id: "123", RunAt: now.Format(time.RFC3339)}); err != nil {
 		t.Fatal(err)
 	}
 	now = now.Add(time.Minute * 5)
-	if err := timetable.Insert(&Task{RunAt: now.Format(time.RFC3339)}); err != nil {
+	if err := timetable.Insert(&Task{Id: "321", RunAt: now.Format(time.RFC3339)}); err != nil {
 		t.Fatal(err)
 	}
 	tasks := timetable.List()
@@ -82,9 +244,9 @@ func TestTimetableList(t *testing.T) {
 func TestTimetableNext(t *testing.T) {
 	now := time.Now()
 	tasks := []*Task{
-		{RunAt: now.Add(time.Minute * 3).Format(time.RFC3339)},
-		{RunAt: now.Format(time.RFC3339)},
-		{RunAt: now.Add(time.Minute * 5).Format(time.RFC3339)},
+		{Id: "1", RunAt: now.Add(time.Minute * 3).Format(time.RFC3339)},
+		{Id: "2", RunAt: now.Format(time.RFC3339)},
+		{Id: "3", RunAt: now.Add(time.Minute * 5).Format(time.RFC3339)},
 	}
 	timetable := NewTimetable("test")
 	if task := timetable.Next(); task != nil {
@@ -101,6 +263,123 @@ func TestTimetableNext(t *testing.T) {
 	}
 }
 
+func TestTimetableNextSharedRunAt(t *testing.T) {
+	runAt := time.Now().Add(-time.Minute).Format(time.RFC3339)
+	timetable := NewTimetable("test")
+	for _, id := range []string{"c", "a", "b"} {
+		if err := timetable.Insert(&Task{Id: id, RunAt: runAt}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range []string{"c", "a", "b"} {
+		if task := timetable.Next(); task == nil || task.Id != id {
+			t.Fatalf("expected task %s to be next", id)
+		}
+	}
+	if task := timetable.Next(); task != nil {
+		t.Fatal("expected task to be nil")
+	}
+}
+
+func TestTimetableNextPriority(t *testing.T) {
+	now := time.Now()
+	timetable := NewTimetable("test")
+	timetable.Order = OrderPriority
+	tasks := []*Task{
+		{Id: "old", RunAt: now.Add(-time.Hour).Format(time.RFC3339), Priority: 1},
+		{Id: "urgent", RunAt: now.Add(-time.Minute).Format(time.RFC3339), Priority: 5},
+		{Id: "late", RunAt: now.Add(-time.Minute).Format(time.RFC3339), Priority: 5},
+		{Id: "future", RunAt: now.Add(time.Hour).Format(time.RFC3339), Priority: 10},
+	}
+	for _, task := range tasks {
+		if err := timetable.Insert(task); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range []string{"urgent", "late", "old"} {
+		if task := timetable.Next(); task == nil || task.Id != id {
+			t.Fatalf("expected task %s to be next", id)
+		}
+	}
+	if task := timetable.Next(); task != nil {
+		t.Fatal("expected tasks that are not due to be skipped")
+	}
+
+	// time ordered timetables ignore the priority.
+	timetable = NewTimetable("test")
+	timetable.Insert(&Task{Id: "low", RunAt: now.Add(-time.Hour).Format(time.RFC3339)})
+	timetable.Insert(&Task{Id: "high", RunAt: now.Add(-time.Minute).Format(time.RFC3339), Priority: 5})
+	if task := timetable.Next(); task == nil || task.Id != "low" {
+		t.Fatal("expected the earliest task to be next")
+	}
+}
+
+func TestTimetableNextRecurring(t *testing.T) {
+	timetable := NewTimetable("test")
+	runAt := time.Now().Add(-time.Minute).Format(time.RFC3339)
+	if err := timetable.Insert(&Task{Id: "123", RunAt: runAt, Cron: "*/5 * * * *"}); err != nil {
+		t.Fatal(err)
+	}
+	task := timetable.Next()
+	if task == nil || task.RunAt != runAt {
+		t.Fatal("expected recurring task to be next")
+	}
+	tasks := timetable.List()
+	if len(tasks) != 1 || tasks[0].Id != "123" || tasks[0].Cron != task.Cron {
+		t.Fatal("expected next occurrence to be scheduled")
+	}
+	at, err := time.Parse(time.RFC3339, tasks[0].RunAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !at.After(time.Now()) || at.After(time.Now().Add(time.Minute*5)) || at.Minute()%5 != 0 {
+		t.Fatalf("got unexpected next occurrence %s", tasks[0].RunAt)
+	}
+}
+
+func TestTimetableNextRRule(t *testing.T) {
+	timetable := NewTimetable("test")
+	start := time.Now().Add(-time.Second * 30)
+	task := &Task{Id: "123", RRule: "FREQ=MINUTELY;COUNT=2"}
+	if err := task.Schedule(FormatRunAt(start), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	timetable.Insert(task)
+	if task := timetable.Next(); task == nil {
+		t.Fatal("expected first occurrence to be next")
+	}
+	tasks := timetable.List()
+	if len(tasks) != 1 || tasks[0].RunAt != FormatRunAt(start.Truncate(time.Second).Add(time.Minute)) {
+		t.Fatal("expected only the following occurrence to be scheduled")
+	}
+	timetable.Remove("123")
+	if err := timetable.recur(tasks[0], start.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if len(timetable.List()) != 0 {
+		t.Fatal("expected the series to end after the count")
+	}
+}
+
+func TestTimetableAckRecurring(t *testing.T) {
+	timetable := NewTimetable("test")
+	runAt := time.Now().Add(-time.Minute).Format(time.RFC3339)
+	timetable.Insert(&Task{Id: "123", RunAt: runAt, Cron: "@hourly"})
+	lease, err := timetable.Claim("w1", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(timetable.List()) != 0 {
+		t.Fatal("expected next occurrence to wait for the ack")
+	}
+	if _, err := timetable.Ack("123", lease.Token); err != nil {
+		t.Fatal(err)
+	}
+	if tasks := timetable.List(); len(tasks) != 1 || tasks[0].Id != "123" {
+		t.Fatal("expected next occurrence to be scheduled")
+	}
+}
+
 func TestTimetableSave(t *testing.T) {
 	var model Model
 	if testing.Short() {
@@ -132,6 +411,175 @@ func TestTimetableMarshalJSON(t *testing.T) {
 	}
 }
 
+func TestTimetableRecurringJSON(t *testing.T) {
+	timetable := NewTimetable("test")
+	timetable.Insert(&Task{Id: "123", RunAt: time.Now().Format(time.RFC3339), Cron: "@daily", TimeZone: "Europe/Berlin"})
+	data, err := json.Marshal(timetable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := new(Timetable)
+	if err := json.Unmarshal(data, decoded); err != nil {
+		t.Fatal(err)
+	}
+	task := decoded.List()[0]
+	if task.Cron != "@daily" || task.TimeZone != "Europe/Berlin" {
+		t.Fatal("expected recurrence to survive the json round trip")
+	}
+}
+
+func TestTimetablePayloadJSON(t *testing.T) {
+	timetable := NewTimetable("test")
+	payload := json.RawMessage(`{"nested":{"list":[1,2.5,"three",null,true],"empty":{}},"text":"line\nbreak \u003ctag\u003e"}`)
+	timetable.Insert(&Task{
+		Id:      "123",
+		RunAt:   time.Now().Format(time.RFC3339),
+		Payload: payload,
+		Labels:  map[string]string{"team": "mail"},
+	})
+	data, err := json.Marshal(timetable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := new(Timetable)
+	if err := json.Unmarshal(data, decoded); err != nil {
+		t.Fatal(err)
+	}
+	task := decoded.List()[0]
+	if string(task.Payload) != string(payload) || task.Labels["team"] != "mail" {
+		t.Fatalf("expected payload and labels to survive the json round trip, got %s %v", task.Payload, task.Labels)
+	}
+}
+
+func TestTimetableMarshalJSONEscaping(t *testing.T) {
+	timetable := NewTimetable(`k"e\y`)
+	runAt := time.Now().Format(time.RFC3339)
+	timetable.Insert(&Task{Id: "a\"b\\c\n", RunAt: runAt})
+	data, err := json.Marshal(timetable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !json.Valid(data) {
+		t.Fatalf("expected valid json, got %s", data)
+	}
+	decoded := new(Timetable)
+	if err := json.Unmarshal(data, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Key != timetable.Key || decoded.List()[0].Id != "a\"b\\c\n" {
+		t.Fatal("expected key and task id to survive the json round trip")
+	}
+}
+
+func TestTimetableMarshalJSONOrder(t *testing.T) {
+	timetable := NewTimetable("test")
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprint(i)
+		timetable.Insert(&Task{Id: id, RunAt: now.Add(time.Duration(i%3) * time.Minute).Format(time.RFC3339)})
+		timetable.leases["lease"+id] = &Lease{Task: &Task{Id: "lease" + id}}
+	}
+	data, err := json.Marshal(timetable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		decoded := new(Timetable)
+		if err := json.Unmarshal(data, decoded); err != nil {
+			t.Fatal(err)
+		}
+		again, err := json.Marshal(decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(again) != string(data) {
+			t.Fatalf("expected stable serialization, got %s and %s", data, again)
+		}
+	}
+}
+
+func TestTimetableUnmarshalJSONErrors(t *testing.T) {
+	docs := []string{
+		`not json`,
+		`[]`,
+		`{"schedule": []}`,
+		`{"_key": 1, "schedule": []}`,
+		`{"_key": "test", "schedule": {}}`,
+		`{"_key": "test", "schedule": [null]}`,
+		`{"_key": "test", "schedule": [{"_key": "1", "runAt": "soon"}]}`,
+		`{"_key": "test", "schedule": [], "leases": [{"token": "abc"}]}`,
+		`{"_key": "test", "schedule": [], "deliveries": [null]}`,
+	}
+	for _, doc := range docs {
+		if err := json.Unmarshal([]byte(doc), new(Timetable)); err == nil {
+			t.Fatalf("%s: expected decode error", doc)
+		}
+	}
+}
+
+func FuzzTimetableMarshalJSON(f *testing.F) {
+	f.Add("test", "123", "Europe/Berlin", `{"a":1}`)
+	f.Add(`k"e\y`, "a\\b\n", "", `"text"`)
+	f.Add("\u2028", "\x00\xff", "\"", `[1,2,{"b":null}]`)
+	runAt := time.Now().Format(time.RFC3339)
+	f.Fuzz(func(t *testing.T, key, id, timeZone, payload string) {
+		if key == "" {
+			t.Skip()
+		}
+		timetable := NewTimetable(key)
+		timetable.TimeZone = timeZone
+		task := &Task{Id: id, RunAt: runAt, Labels: map[string]string{id: key}}
+		if json.Valid([]byte(payload)) {
+			task.Payload = json.RawMessage(payload)
+		}
+		timetable.Insert(task)
+		data, err := json.Marshal(timetable)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !json.Valid(data) {
+			t.Fatalf("invalid json %q", data)
+		}
+		decoded := new(Timetable)
+		if err := json.Unmarshal(data, decoded); err != nil {
+			t.Fatal(err)
+		}
+		again, err := json.Marshal(decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(again) != string(data) {
+			t.Fatalf("expected %s, got %s", data, again)
+		}
+	})
+}
+
+func FuzzTimetableUnmarshalJSON(f *testing.F) {
+	runAt := time.Now().Format(time.RFC3339)
+	f.Add([]byte(fmt.Sprintf(`{"_key":"test","schedule":[{"_key":"123","runAt":"%s"}]}`, runAt)))
+	f.Add([]byte(fmt.Sprintf(`{"_key":"test","schedule":[],"leases":[{"task":{"_key":"1","runAt":"%s"},"token":"abc"}]}`, runAt)))
+	f.Add([]byte(`{"_key":"test","schedule":[null]}`))
+	f.Add([]byte(`{"_key":{},"schedule":"x"}`))
+	f.Add([]byte(`{`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decoded := new(Timetable)
+		if err := json.Unmarshal(data, decoded); err != nil {
+			return
+		}
+		encoded, err := json.Marshal(decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		again := new(Timetable)
+		if err := json.Unmarshal(encoded, again); err != nil {
+			t.Fatalf("%s: %s", encoded, err)
+		}
+		if again.Key != decoded.Key || len(again.List()) != len(decoded.List()) || len(again.Leases()) != len(decoded.Leases()) {
+			t.Fatalf("expected %s to survive the json round trip", encoded)
+		}
+	})
+}
+
 func TestTimetableUnmarshalJSON(t *testing.T) {
 	timetable := new(Timetable)
 	runAt := time.Now().Format(time.RFC3339)
@@ -142,7 +590,371 @@ func TestTimetableUnmarshalJSON(t *testing.T) {
 	if timetable.Key != "test" {
 		t.Fatal("expected timetable key to be 'test'")
 	}
+	if timetable.Exclusive {
+		t.Fatal("expected timetable not to be exclusive")
+	}
 	if timetable.List()[0].RunAt != runAt {
 		t.Fatalf("expected timetable run at to be %s", runAt)
 	}
 }
+
+func TestTimetableUnmarshalJSONLegacy(t *testing.T) {
+	now := time.Now()
+	b := []byte(fmt.Sprintf(`{"_key": "test", "schedule": [{"_key": "a", "runAt": "%s"}, {"_key": "b", "runAt": "%s"}]}`,
+		now.String(), now.Add(time.Minute).Round(0).String()))
+	timetable := new(Timetable)
+	if err := json.Unmarshal(b, timetable); err != nil {
+		t.Fatal(err)
+	}
+	tasks := timetable.List()
+	if len(tasks) != 2 || tasks[0].Id != "a" || tasks[1].Id != "b" {
+		t.Fatal("expected the baseline tasks to be loaded in order")
+	}
+	if tasks[0].RunAt != FormatRunAt(now) {
+		t.Fatalf("expected the run at time to be normalized, got %s", tasks[0].RunAt)
+	}
+}
+
+func TestTimetableUnmarshalJSONDuplicates(t *testing.T) {
+	now := time.Now()
+	early := now.Add(-time.Hour).Format(time.RFC3339)
+	late := now.Add(time.Hour).Format(time.RFC3339)
+	b := []byte(fmt.Sprintf(`{"_key": "test", "schedule": [
+		{"_key": "a", "runAt": "%s"}, {"_key": "a", "runAt": "%s"},
+		{"_key": "b", "runAt": "%s"}, {"_key": "b", "runAt": "%s"},
+		{"_key": "c", "runAt": "%s"}
+	], "leases": [{"task": {"_key": "c", "runAt": "%s"}, "token": "abc"}, {"task": {"_key": "c", "runAt": "%s"}, "token": "def"}]}`,
+		late, early, early, late, early, early, late))
+	timetable := new(Timetable)
+	if err := json.Unmarshal(b, timetable); err != nil {
+		t.Fatal(err)
+	}
+	tasks := timetable.List()
+	if len(tasks) != 2 || tasks[0].RunAt != early || tasks[1].RunAt != early {
+		t.Fatal("expected the earliest occurrence of each task to be kept")
+	}
+	if leases := timetable.Leases(); len(leases) != 1 || leases[0].Token != "abc" {
+		t.Fatal("expected the first lease to be kept over the scheduled task")
+	}
+}
+
+func TestTimetableClaim(t *testing.T) {
+	timetable := NewTimetable("test")
+	if lease, err := timetable.Claim("w1", time.Minute); err != nil || lease != nil {
+		t.Fatal("expected no lease from an empty timetable")
+	}
+	runAt := time.Now().Add(-time.Minute).Format(time.RFC3339)
+	if err := timetable.Insert(&Task{Id: "123", RunAt: runAt}); err != nil {
+		t.Fatal(err)
+	}
+	lease, err := timetable.Claim("w1", time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.Task.Id != "123" || lease.WorkerId != "w1" || lease.Token == "" {
+		t.Fatal("got unexpected lease")
+	}
+	if len(timetable.List()) != 0 {
+		t.Fatal("expected claimed task to leave the schedule")
+	}
+	time.Sleep(time.Millisecond * 2)
+	reclaimed, err := timetable.Claim("w2", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reclaimed == nil || reclaimed.Task.Id != "123" || reclaimed.WorkerId != "w2" {
+		t.Fatal("expected expired lease to be claimed again")
+	}
+	if reclaimed.Token == lease.Token {
+		t.Fatal("expected a new lease token")
+	}
+	if lease, _ := timetable.Claim("w3", time.Minute); lease != nil {
+		t.Fatal("expected active lease not to be claimed")
+	}
+}
+
+func TestTimetableClaimOrder(t *testing.T) {
+	timetable := NewTimetable("test")
+	timetable.Order = OrderPriority
+	runAt := time.Now().Add(-time.Minute).Format(time.RFC3339)
+	if err := timetable.Insert(&Task{Id: "low", RunAt: runAt}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := timetable.Claim("w1", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := timetable.Insert(&Task{Id: "high", RunAt: runAt, Priority: 100}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"high", "low"} {
+		lease, err := timetable.Claim("w2", time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lease == nil || lease.Task.Id != id {
+			t.Fatalf("expected task %s to be claimed, got %v", id, lease)
+		}
+	}
+
+	// expired leases go first among tasks that rank the same.
+	timetable = NewTimetable("test")
+	timetable.Insert(&Task{Id: "a", RunAt: runAt})
+	timetable.Claim("w1", 0)
+	timetable.Insert(&Task{Id: "b", RunAt: runAt})
+	if lease, _ := timetable.Claim("w2", time.Minute); lease == nil || lease.Task.Id != "a" {
+		t.Fatalf("expected the expired lease to be claimed, got %v", lease)
+	}
+}
+
+func TestTimetableAck(t *testing.T) {
+	timetable := NewTimetable("test")
+	timetable.Insert(&Task{Id: "123", RunAt: time.Now().Format(time.RFC3339)})
+	lease, err := timetable.Claim("w1", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := timetable.Ack("123", "bad"); err != ErrInvalidLeaseToken {
+		t.Fatal("expected invalid lease token error")
+	}
+	if _, err := timetable.Ack("123", lease.Token); err != nil {
+		t.Fatal(err)
+	}
+	if len(timetable.Leases()) != 0 {
+		t.Fatal("expected lease to be removed")
+	}
+	if _, err := timetable.Ack("123", lease.Token); err != ErrTaskNotFound {
+		t.Fatal("expected lease not found error")
+	}
+}
+
+func TestTimetableNack(t *testing.T) {
+	timetable := NewTimetable("test")
+	timetable.Insert(&Task{Id: "123", RunAt: time.Now().Format(time.RFC3339)})
+	lease, err := timetable.Claim("w1", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	retryAt := time.Now().Add(time.Minute).Format(time.RFC3339)
+	if _, err := timetable.Nack("123", lease.Token, retryAt); err != nil {
+		t.Fatal(err)
+	}
+	if len(timetable.Leases()) != 0 {
+		t.Fatal("expected lease to be removed")
+	}
+	tasks := timetable.List()
+	if len(tasks) != 1 || tasks[0].RunAt != retryAt {
+		t.Fatal("expected task to be rescheduled at the retry time")
+	}
+}
+
+func TestTimetableLeasesJSON(t *testing.T) {
+	timetable := NewTimetable("test")
+	timetable.Insert(&Task{Id: "123", RunAt: time.Now().Format(time.RFC3339)})
+	lease, err := timetable.Claim("w1", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(timetable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := new(Timetable)
+	if err := json.Unmarshal(data, decoded); err != nil {
+		t.Fatal(err)
+	}
+	leases := decoded.Leases()
+	if len(leases) != 1 || leases[0].Token != lease.Token || !leases[0].ExpiresAt.Equal(lease.ExpiresAt) {
+		t.Fatal("expected lease to survive the json round trip")
+	}
+}
+
+func TestTimetableExclusiveJSON(t *testing.T) {
+	timetable := NewTimetable("test")
+	timetable.Exclusive = true
+	data, err := json.Marshal(timetable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := new(Timetable)
+	if err := json.Unmarshal(data, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Exclusive {
+		t.Fatal("expected timetable to be exclusive")
+	}
+}
+
+// benchmarkTimetable returns a timetable holding n tasks scheduled over
+// the past day.
+func benchmarkTimetable(n int) *Timetable {
+	timetable := NewTimetable("bench")
+	now := time.Now()
+	for i := 0; i < n; i++ {
+		timetable.Insert(&Task{
+			Id:    fmt.Sprint(i),
+			RunAt: now.Add(-time.Duration(i%86400) * time.Second).Format(time.RFC3339),
+		})
+	}
+	return timetable
+}
+
+// mapSchedule is the schedule keyed on run at times that the timetable
+// kept before the heap.  It is the baseline of the benchmarks.
+type mapSchedule map[string]*Task
+
+// benchmarkMapSchedule returns a baseline schedule holding n tasks at
+// distinct run at times in the past.
+func benchmarkMapSchedule(n int) mapSchedule {
+	schedule := make(mapSchedule)
+	now := time.Now()
+	for i := 0; i < n; i++ {
+		runAt := now.Add(-time.Duration(i) * time.Second).Format(time.RFC3339)
+		schedule[runAt] = &Task{Id: fmt.Sprint(i), RunAt: runAt}
+	}
+	return schedule
+}
+
+// delay sorts the run at times to find the first one, as Delay did.
+func (schedule mapSchedule) delay() int {
+	keys := make([]string, 0, len(schedule))
+	for runAt := range schedule {
+		keys = append(keys, runAt)
+	}
+	sort.Strings(keys)
+	t, _ := time.Parse(time.RFC3339, keys[0])
+	return int(t.Sub(time.Now()).Minutes())
+}
+
+// next parses every run at time to find the first task, as Next did.
+func (schedule mapSchedule) next() *Task {
+	var next *time.Time
+	for runAt := range schedule {
+		t, _ := time.Parse(time.RFC3339, runAt)
+		if next == nil || t.Before(*next) {
+			next = &t
+		}
+	}
+	task := schedule[next.Format(time.RFC3339)]
+	delete(schedule, task.RunAt)
+	return task
+}
+
+// remove scans the schedule for the task id, as Remove did.
+func (schedule mapSchedule) remove(id string) {
+	for runAt, task := range schedule {
+		if task.Id == id {
+			delete(schedule, runAt)
+			return
+		}
+	}
+}
+
+func BenchmarkTimetableDelay(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprintf("heap/%d", n), func(b *testing.B) {
+			timetable := benchmarkTimetable(n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				timetable.Delay()
+			}
+		})
+		b.Run(fmt.Sprintf("map/%d", n), func(b *testing.B) {
+			schedule := benchmarkMapSchedule(n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				schedule.delay()
+			}
+		})
+	}
+}
+
+func BenchmarkTimetableInsertRemove(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprintf("heap/%d", n), func(b *testing.B) {
+			timetable := benchmarkTimetable(n)
+			runAt := time.Now().Format(time.RFC3339)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				timetable.Insert(&Task{Id: "bench", RunAt: runAt})
+				timetable.Remove("bench")
+			}
+		})
+		b.Run(fmt.Sprintf("map/%d", n), func(b *testing.B) {
+			schedule := benchmarkMapSchedule(n)
+			runAt := time.Now().Add(time.Hour).Format(time.RFC3339)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				schedule[runAt] = &Task{Id: "bench", RunAt: runAt}
+				schedule.remove("bench")
+			}
+		})
+	}
+}
+
+func BenchmarkTimetableNext(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprintf("heap/%d", n), func(b *testing.B) {
+			timetable := benchmarkTimetable(n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				timetable.Insert(timetable.Next())
+			}
+		})
+		b.Run(fmt.Sprintf("map/%d", n), func(b *testing.B) {
+			schedule := benchmarkMapSchedule(n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				task := schedule.next()
+				schedule[task.RunAt] = task
+			}
+		})
+	}
+}
+
+func TestTimetableDispatch(t *testing.T) {
+	timetable := NewTimetable("test")
+	past := time.Now().Add(-time.Minute).Format(time.RFC3339)
+	timetable.Insert(&Task{Id: "plain", RunAt: past})
+	timetable.Insert(&Task{Id: "hook", RunAt: past, Callback: &Callback{Url: "http://example.com"}})
+	timetable.Insert(&Task{Id: "later", RunAt: time.Now().Add(time.Hour).Format(time.RFC3339), Callback: &Callback{Url: "http://example.com"}})
+	leases, err := timetable.Dispatch("d1", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leases) != 1 || leases[0].Task.Id != "hook" || leases[0].WorkerId != "d1" {
+		t.Fatal("expected only the due task with a callback to be leased")
+	}
+	if len(timetable.List()) != 2 {
+		t.Fatal("expected the other tasks to stay scheduled")
+	}
+
+	// the timetable callback applies to tasks without one.
+	timetable.Callback = &Callback{Url: "http://example.com"}
+	timetable.Release("hook")
+	leases, err = timetable.Dispatch("d1", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leases) != 2 {
+		t.Fatalf("expected the expired lease and task plain to be leased, got %d", len(leases))
+	}
+
+	timetable.Record(&Delivery{TaskId: "hook", Status: DeliveryDelivered, Attempts: 1})
+	data, err := json.Marshal(timetable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := new(Timetable)
+	if err := json.Unmarshal(data, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Callback == nil || decoded.Callback.Url != "http://example.com" || len(decoded.Deliveries()) != 1 {
+		t.Fatal("expected the callback and deliveries to survive the json round trip")
+	}
+	for i := 0; i < MaxDeliveryHistory; i++ {
+		timetable.Record(&Delivery{TaskId: "hook"})
+	}
+	if len(timetable.Deliveries()) != MaxDeliveryHistory {
+		t.Fatalf("expected %d deliveries to be kept", MaxDeliveryHistory)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"time"
+
+	// embed the time zone database so zones resolve on hosts and images
+	// without one.
+	_ "time/tzdata"
+)
+
+// LoadLocation returns the IANA time zone with the provided name.  UTC
+// is returned if the name is empty.
+func LoadLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(name)
+}
+
+// WallClock returns the wall clock reading of the point in time in the
+// location as a UTC time.
+func WallClock(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+// ResolveWallClock returns the point in time at which the wall clock
+// reading, given as a UTC time, occurs in the location.  A reading that
+// is skipped by a daylight saving transition is moved forward by the
+// length of the transition, so 02:30 becomes 03:30 when clocks jump
+// from 02:00 to 03:00.  A reading that occurs twice resolves to its
+// first occurrence.
+func ResolveWallClock(wall time.Time, loc *time.Location) time.Time {
+	// the offsets in effect a day either side of the reading cover any
+	// transition close to it.
+	_, before := wall.Add(-time.Hour * 24).In(loc).Zone()
+	_, after := wall.Add(time.Hour * 24).In(loc).Zone()
+	early := wall.Add(-time.Duration(before) * time.Second)
+	late := wall.Add(-time.Duration(after) * time.Second)
+	if late.Before(early) {
+		early, late = late, early
+	}
+	for _, t := range []time.Time{early, late} {
+		if WallClock(t, loc).Equal(wall) {
+			return t.In(loc)
+		}
+	}
+	// the reading was skipped, read it with the offset in effect before
+	// the transition.
+	return wall.Add(-time.Duration(before) * time.Second).In(loc)
+}
+
+// zonedRecurrence evaluates a recurrence on the wall clock of a
+// location.  Occurrences are resolved with ResolveWallClock.
+type zonedRecurrence struct {
+	// wall is the recurrence of wall clock readings given as UTC times.
+	// loc is the location of the wall clock.
+	wall Recurrence
+	loc  *time.Location
+}
+
+// Next returns the first occurrence after the provided time.
+func (r *zonedRecurrence) Next(t time.Time) time.Time {
+	wall := WallClock(t, r.loc)
+	for {
+		if wall = r.wall.Next(wall); wall.IsZero() {
+			return wall
+		}
+		// readings repeated by a transition resolve to their first
+		// occurrence, which may not be after the provided time.
+		if at := ResolveWallClock(wall, r.loc); at.After(t) {
+			return at
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoadLocation(t *testing.T) {
+	if loc, err := LoadLocation(""); err != nil || loc != time.UTC {
+		t.Fatal("expected empty time zone to be utc")
+	}
+	if _, err := LoadLocation("Europe/Berlin"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadLocation("Nowhere/Special"); err == nil {
+		t.Fatal("expected unknown time zone error")
+	}
+}
+
+func TestResolveWallClock(t *testing.T) {
+	berlin, err := LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		wall time.Time
+		want time.Time
+	}{
+		// an ordinary reading.
+		{time.Date(2018, 3, 1, 9, 0, 0, 0, time.UTC), time.Date(2018, 3, 1, 8, 0, 0, 0, time.UTC)},
+		// clocks jump from 02:00 to 03:00, 02:30 is moved to 03:30.
+		{time.Date(2018, 3, 25, 2, 30, 0, 0, time.UTC), time.Date(2018, 3, 25, 1, 30, 0, 0, time.UTC)},
+		// clocks fall back from 03:00 to 02:00, 02:30 resolves to the
+		// first occurrence.
+		{time.Date(2018, 10, 28, 2, 30, 0, 0, time.UTC), time.Date(2018, 10, 28, 0, 30, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		if got := ResolveWallClock(test.wall, berlin); !got.Equal(test.want) {
+			t.Fatalf("%s: expected %s, got %s", test.wall, test.want, got.UTC())
+		}
+	}
+}
+
+func TestCronDaylightSaving(t *testing.T) {
+	recurrence, err := ParseCron("30 2 * * *", "Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []time.Time{
+		time.Date(2018, 3, 24, 1, 30, 0, 0, time.UTC),
+		time.Date(2018, 3, 25, 1, 30, 0, 0, time.UTC), // skipped 02:30 runs at 03:30
+		time.Date(2018, 3, 26, 0, 30, 0, 0, time.UTC),
+	}
+	at := time.Date(2018, 3, 23, 12, 0, 0, 0, time.UTC)
+	for _, w := range want {
+		if at = recurrence.Next(at); !at.Equal(w) {
+			t.Fatalf("expected %s, got %s", w, at.UTC())
+		}
+	}
+	want = []time.Time{
+		time.Date(2018, 10, 27, 0, 30, 0, 0, time.UTC),
+		time.Date(2018, 10, 28, 0, 30, 0, 0, time.UTC), // repeated 02:30 runs once
+		time.Date(2018, 10, 29, 1, 30, 0, 0, time.UTC),
+	}
+	at = time.Date(2018, 10, 26, 12, 0, 0, 0, time.UTC)
+	for _, w := range want {
+		if at = recurrence.Next(at); !at.Equal(w) {
+			t.Fatalf("expected %s, got %s", w, at.UTC())
+		}
+	}
+}
+
+func TestRRuleDaylightSaving(t *testing.T) {
+	start := time.Date(2018, 3, 24, 8, 0, 0, 0, time.UTC) // 09:00 in berlin
+	recurrence, err := ParseRRule("FREQ=DAILY", start, "Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := recurrence.Next(start)
+	if !at.Equal(time.Date(2018, 3, 25, 7, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected 09:00 wall clock after the transition, got %s", at.UTC())
+	}
+	recurrence, err = ParseRRule("FREQ=HOURLY", time.Date(2018, 10, 27, 23, 0, 0, 0, time.UTC), "Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at = time.Date(2018, 10, 27, 23, 0, 0, 0, time.UTC)
+	want := []time.Time{
+		time.Date(2018, 10, 28, 0, 0, 0, 0, time.UTC), // 02:00 cest
+		time.Date(2018, 10, 28, 2, 0, 0, 0, time.UTC), // 03:00 cet
+	}
+	for _, w := range want {
+		if at = recurrence.Next(at); !at.Equal(w) {
+			t.Fatalf("expected %s, got %s", w, at.UTC())
+		}
+	}
+}
+
+func TestParseRunAtTimeZone(t *testing.T) {
+	berlin, err := LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2018, 3, 24, 9, 0, 0, 0, berlin)
+	at, err := ParseRunAt("2018-03-25T09:00:00", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !at.Equal(time.Date(2018, 3, 25, 7, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected wall clock time in berlin, got %s", at.UTC())
+	}
+	at, err = ParseRunAt("+1d", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !at.Equal(time.Date(2018, 3, 25, 7, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected a calendar day across the transition, got %s", at.UTC())
+	}
+	at, err = ParseRunAt("+1d2h", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !at.Equal(time.Date(2018, 3, 25, 9, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected a calendar day and two hours, got %s", at.UTC())
+	}
+	if _, err := ParseRunAt("+xd", now); err == nil {
+		t.Fatal("expected relative run at parse error")
+	}
+}